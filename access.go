@@ -0,0 +1,33 @@
+package atm
+
+import "time"
+
+func ByLastAccess(h []*CacheItem, i, j int) bool {
+	return h[i].lastAccessedAt.Before(h[j].lastAccessedAt)
+}
+
+// touchWithLock records that an already cached item was written again at
+// insertionDate.
+func (c *Cache) touchWithLock(cacheItem *CacheItem, insertionDate time.Time) { //this func should always be call within a cache lock
+	cacheItem.insertedAt = insertionDate
+	cacheItem.lastAccessedAt = insertionDate
+	c.accessedWithLock(cacheItem)
+}
+
+// recordAccess marks cacheItem as accessed now and reports it to the eviction
+// policy, unless the policy ignores reads.
+func (c *Cache) recordAccess(cacheItem *CacheItem) {
+	if !c.trackAccess {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.index[cacheItem.key] != cacheItem {
+		return
+	}
+
+	cacheItem.lastAccessedAt = c.now()
+	c.accessedWithLock(cacheItem)
+}
@@ -0,0 +1,86 @@
+package atm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_AccessOrder(t *testing.T) {
+	SystemBlockSize = 0
+
+	for _, test := range []struct {
+		name            string
+		opts            []Option
+		expectedEvicted string
+	}{
+		{"insertion order", nil, "a"},
+		{"access order", []Option{WithAccessOrder()}, "b"},
+		{"access order with memory tier", []Option{WithAccessOrder(), WithMemoryTier(100)}, "b"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryIO()
+			opts := append([]Option{withNow(func() time.Time { return ttime(10) })}, test.opts...)
+			cache := NewCache("/cache", 15, 0, store, opts...)
+			defer cache.Close(context.Background())
+
+			for i, key := range []string{"a", "b", "c"} {
+				_, err := cache.Write(key, ttime(i), ttime(i), []byte("12345"))
+				require.NoError(t, err)
+			}
+
+			_, found, err := cache.Read("a")
+			require.NoError(t, err)
+			require.True(t, found)
+
+			_, err = cache.Write("d", ttime(3), ttime(3), []byte("12345"))
+			require.NoError(t, err)
+			requireConsistent(t, cache, store)
+			require.NotContains(t, cache.index, test.expectedEvicted)
+			require.Len(t, cache.index, 3)
+		})
+	}
+}
+
+func TestCache_RewriteFixesHeapOrder(t *testing.T) {
+	SystemBlockSize = 0
+	cache := NewCache("/cache", 15, 0, NewMemoryIO())
+	defer cache.Close(context.Background())
+
+	for i, key := range []string{"a", "b", "c"} {
+		_, err := cache.Write(key, ttime(i), ttime(i), []byte("12345"))
+		require.NoError(t, err)
+	}
+
+	_, err := cache.Write("a", ttime(0), ttime(5), []byte("12345"))
+	require.NoError(t, err)
+	_, err = cache.Write("d", ttime(3), ttime(6), []byte("12345"))
+	require.NoError(t, err)
+
+	require.Contains(t, cache.index, "a")
+	require.NotContains(t, cache.index, "b")
+}
+
+func TestCache_AccessOrderManifest(t *testing.T) {
+	basePath := t.TempDir()
+
+	cache, err := NewInitializedCache(basePath, 100_000, 100_000, NewFileIO(), WithAccessOrder(), withNow(func() time.Time { return ttime(10) }))
+	require.NoError(t, err)
+
+	_, err = cache.Write("a", ttime(0), ttime(0), []byte("a"))
+	require.NoError(t, err)
+	_, err = cache.Write("b", ttime(1), ttime(1), []byte("b"))
+	require.NoError(t, err)
+	_, _, err = cache.Read("a")
+	require.NoError(t, err)
+	require.NoError(t, cache.Close(context.Background()))
+
+	reopened, err := NewInitializedCache(basePath, 100_000, 100_000, NewFileIO(), WithAccessOrder())
+	require.NoError(t, err)
+	defer reopened.Close(context.Background())
+
+	require.Equal(t, ttime(10), reopened.index["a"].lastAccessedAt.UTC())
+	require.Equal(t, "b", recentAge(reopened).recentEntryHeap.Peek().key)
+}
@@ -0,0 +1,170 @@
+package atm
+
+import (
+	"container/heap"
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+// ErrNotAdmitted is returned when writing an item the admission filter
+// estimates less frequently accessed than the items it would evict.
+var ErrNotAdmitted = errors.New("item not admitted")
+
+// VictimPeeker is implemented by eviction policies able to tell which items
+// Victims would evict from the cache, leaving out the ones it would only move
+// to another tier, without evicting them. The admission filter compares new
+// items against those.
+type VictimPeeker interface {
+	PeekVictims(neededBytes int) []*CacheItem
+}
+
+// PeekVictims returns the items Victims would drop from the cache. It runs
+// Victims and undoes it, putting every item back in the heap it came from.
+func (p *RecentAgePolicy) PeekVictims(neededBytes int) (victims []*CacheItem) {
+	recentEntryEvictions, ageEvictions := p.recentEntryEvictions, p.ageEvictions
+	evictions, fromRecent := p.victims(neededBytes)
+
+	recent := make(map[*CacheItem]bool, len(fromRecent))
+	for _, item := range fromRecent {
+		recent[item] = true
+	}
+
+	for _, eviction := range evictions {
+		if eviction.Promoted {
+			p.ageHeap.Remove(eviction.Item.key)
+			continue
+		}
+
+		victims = append(victims, eviction.Item)
+		if !recent[eviction.Item] {
+			heap.Push(p.ageHeap, eviction.Item)
+		}
+	}
+	for _, item := range fromRecent {
+		heap.Push(p.recentEntryHeap, item)
+	}
+
+	p.recentEntryEvictions, p.ageEvictions = recentEntryEvictions, ageEvictions
+	return victims
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCounter = 15
+	// sketchSampleFactor times the expected item count increments trigger the
+	// aging of every counter
+	sketchSampleFactor = 10
+)
+
+// countMinSketch estimates how often keys are accessed with 4-bit counters,
+// halved every sample period so past popularity fades away.
+type countMinSketch struct {
+	mu           sync.Mutex
+	counters     [sketchDepth][]uint8
+	mask         uint64
+	additions    int
+	samplePeriod int
+}
+
+func newCountMinSketch(expectedItems int) *countMinSketch {
+	width := 16
+	for width < expectedItems {
+		width <<= 1
+	}
+
+	s := &countMinSketch{mask: uint64(width - 1), samplePeriod: sketchSampleFactor * width}
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, width)
+	}
+
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) (out [sketchDepth]uint64) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+
+	low, high := sum&0xFFFFFFFF, sum>>32
+	for i := range out {
+		out[i] = (low + uint64(i)*high) & s.mask
+	}
+
+	return out
+}
+
+func (s *countMinSketch) increment(key string) {
+	indexes := s.indexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, index := range indexes {
+		if s.counters[i][index] < sketchMaxCounter {
+			s.counters[i][index]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.samplePeriod {
+		s.age()
+	}
+}
+
+// age halves every counter.
+func (s *countMinSketch) age() {
+	for i := range s.counters {
+		for j := range s.counters[i] {
+			s.counters[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	indexes := s.indexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	estimate := uint8(sketchMaxCounter)
+	for i, index := range indexes {
+		if counter := s.counters[i][index]; counter < estimate {
+			estimate = counter
+		}
+	}
+
+	return estimate
+}
+
+// recordLookup counts a lookup of key, cached or not, in the admission
+// filter.
+func (c *Cache) recordLookup(key string) {
+	if c.admission != nil {
+		c.admission.increment(key)
+	}
+}
+
+// admitWithLock tells whether cacheItem may evict the items standing in its
+// way, which is the case when it is estimated to be accessed more often than
+// each of them, or when none of them was ever accessed.
+func (c *Cache) admitWithLock(cacheItem *CacheItem, neededBytes int) bool { //this func should always be call within a cache lock
+	if c.admission == nil || cacheItem.reversible {
+		return true
+	}
+
+	peeker, ok := c.policy.(VictimPeeker)
+	if !ok {
+		return true
+	}
+
+	var victimFrequency uint8
+	for _, victim := range peeker.PeekVictims(neededBytes) {
+		if estimate := c.admission.estimate(victim.key); estimate > victimFrequency {
+			victimFrequency = estimate
+		}
+	}
+
+	return victimFrequency == 0 || c.admission.estimate(cacheItem.key) > victimFrequency
+}
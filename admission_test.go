@@ -0,0 +1,135 @@
+package atm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	sketch := newCountMinSketch(16)
+	require.Equal(t, uint8(0), sketch.estimate("a"))
+
+	for i := 0; i < 3; i++ {
+		sketch.increment("a")
+	}
+	require.Equal(t, uint8(3), sketch.estimate("a"))
+	require.Equal(t, uint8(0), sketch.estimate("b"))
+
+	// Counters saturate, then get halved once the sample period is reached
+	for i := 3; i < sketch.samplePeriod-1; i++ {
+		sketch.increment("a")
+	}
+	require.Equal(t, uint8(sketchMaxCounter), sketch.estimate("a"))
+
+	sketch.increment("a")
+	require.Equal(t, uint8(sketchMaxCounter/2), sketch.estimate("a"))
+	require.Equal(t, sketch.samplePeriod/2, sketch.additions)
+}
+
+func TestCache_AdmissionFilter(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	cache := NewCache("/cache", 10, 0, store, WithAdmissionFilter(100))
+	defer cache.Close(context.Background())
+
+	lookup := func(key string, times int) {
+		t.Helper()
+		for i := 0; i < times; i++ {
+			_, _, err := cache.Read(key)
+			require.NoError(t, err)
+		}
+	}
+
+	_, err := cache.Write("a", ttime(0), ttime(0), []byte("12345"))
+	require.NoError(t, err)
+	_, err = cache.Write("b", ttime(1), ttime(1), []byte("12345"))
+	require.NoError(t, err)
+	lookup("a", 3)
+	lookup("b", 3)
+
+	// A scan over cold keys leaves the hot ones in place
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("scan%d", i)
+		lookup(key, 1)
+		_, err := cache.Write(key, ttime(2+i), ttime(2+i), []byte("12345"))
+		require.True(t, errors.Is(err, ErrNotAdmitted))
+	}
+	lookup("scan5", 1)
+	_, err = cache.WriteFrom("scan5", ttime(7), ttime(7), bytes.NewReader([]byte("12345")))
+	require.True(t, errors.Is(err, ErrNotAdmitted))
+
+	requireConsistent(t, cache, store)
+	require.Equal(t, 2, store.Len())
+	require.Len(t, cache.index, 2)
+	require.True(t, recentAge(cache).recentEntryHeap.Contains("a"))
+	require.True(t, recentAge(cache).recentEntryHeap.Contains("b"))
+	require.Equal(t, uint64(6), cache.Stats().AdmissionRejections)
+
+	// A key looked up more often than the victim gets in
+	lookup("c", 4)
+	_, err = cache.Write("c", ttime(8), ttime(8), []byte("12345"))
+	require.NoError(t, err)
+	requireConsistent(t, cache, store)
+	require.NotContains(t, cache.index, "a")
+	require.True(t, recentAge(cache).recentEntryHeap.Contains("b"))
+	require.True(t, recentAge(cache).recentEntryHeap.Contains("c"))
+
+	// Writes not evicting anything are always admitted
+	_, err = cache.Delete("b")
+	require.NoError(t, err)
+	_, err = cache.Write("d", ttime(9), ttime(9), []byte("12345"))
+	require.NoError(t, err)
+	require.Contains(t, cache.index, "d")
+}
+
+func TestCache_AdmissionFilterAgeTier(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	cache := NewCache("/cache", 10, 10, store, WithAdmissionFilter(100))
+	defer cache.Close(context.Background())
+
+	write := func(key string, offset int) error {
+		_, err := cache.Write(key, ttime(offset), ttime(offset), []byte("12345"))
+		return err
+	}
+	lookup := func(key string, times int) {
+		t.Helper()
+		for i := 0; i < times; i++ {
+			_, _, err := cache.Read(key)
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, write("a", 0))
+	require.NoError(t, write("b", 1))
+	lookup("a", 3)
+	lookup("b", 3)
+
+	// Hot items moved to the age heap are not lost, the cold items get in
+	for i, key := range []string{"scan0", "scan1"} {
+		lookup(key, 1)
+		require.NoError(t, write(key, 2+i))
+	}
+	require.True(t, recentAge(cache).ageHeap.Contains("a"))
+	require.True(t, recentAge(cache).ageHeap.Contains("b"))
+
+	// A full age heap would drop a hot item, the cold item is refused
+	lookup("scan2", 1)
+	require.True(t, errors.Is(write("scan2", 4), ErrNotAdmitted))
+	requireConsistent(t, cache, store)
+	require.Len(t, cache.index, 4)
+	require.Equal(t, uint64(2), cache.Stats().RecentEntryEvictions)
+	require.Equal(t, uint64(0), cache.Stats().AgeEvictions)
+
+	// Hotter than the dropped item, it gets in
+	lookup("c", 4)
+	require.NoError(t, write("c", 5))
+	requireConsistent(t, cache, store)
+	require.NotContains(t, cache.index, "a")
+	require.True(t, recentAge(cache).recentEntryHeap.Contains("c"))
+}
@@ -0,0 +1,320 @@
+package atm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlockKey identifies a block by its number and ID, several blocks may share a
+// number when the chain forked.
+type BlockKey struct {
+	Num uint64
+	ID  string
+}
+
+// String returns the cache key of the block, `<num>.<id>`.
+func (k BlockKey) String() string {
+	return strconv.FormatUint(k.Num, 10) + "." + k.ID
+}
+
+// ParseBlockKey decodes a cache key written by BlockKey.String, numbers with
+// leading zeros are refused so every block has a single key.
+func ParseBlockKey(key string) (BlockKey, error) {
+	separator := strings.Index(key, ".")
+	if separator == -1 {
+		return BlockKey{}, fmt.Errorf("invalid block key %q, missing separator", key)
+	}
+
+	num, err := strconv.ParseUint(key[:separator], 10, 64)
+	if err != nil {
+		return BlockKey{}, fmt.Errorf("invalid block key %q: %w", key, err)
+	}
+	if strconv.FormatUint(num, 10) != key[:separator] {
+		return BlockKey{}, fmt.Errorf("invalid block key %q, non canonical number", key)
+	}
+
+	return BlockKey{Num: num, ID: key[separator+1:]}, nil
+}
+
+// Block is a cached block returned by BlockCache.ReadRange.
+type Block struct {
+	Key  BlockKey
+	Data []byte
+}
+
+// BlockCache is a facade over a Cache whose keys are blocks, it keeps the
+// cached blocks ordered by number so block ranges can be queried.
+type BlockCache struct {
+	cache *Cache
+}
+
+// NewBlockCache wraps cache, indexing the blocks it already holds. Keys of the
+// cache that are not block keys are left out of the block index.
+func NewBlockCache(cache *Cache) *BlockCache {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.blocks == nil {
+		cache.blocks = newBlockIndex()
+		for key := range cache.index {
+			cache.blocks.add(key)
+		}
+	}
+
+	return &BlockCache{cache: cache}
+}
+
+// Cache returns the wrapped cache.
+func (b *BlockCache) Cache() *Cache {
+	return b.cache
+}
+
+func (b *BlockCache) Write(key BlockKey, itemDate time.Time, insertionDate time.Time, data []byte, opts ...WriteOption) (*CacheItem, error) {
+	return b.cache.Write(key.String(), itemDate, insertionDate, data, opts...)
+}
+
+func (b *BlockCache) WriteFrom(key BlockKey, itemDate time.Time, insertionDate time.Time, reader io.Reader, opts ...WriteOption) (*CacheItem, error) {
+	return b.cache.WriteFrom(key.String(), itemDate, insertionDate, reader, opts...)
+}
+
+func (b *BlockCache) Read(key BlockKey) (data []byte, found bool, err error) {
+	return b.cache.Read(key.String())
+}
+
+func (b *BlockCache) OpenReader(key BlockKey) (reader io.ReadCloser, found bool, err error) {
+	return b.cache.OpenReader(key.String())
+}
+
+// Keys returns the keys of the blocks cached between from and to inclusively,
+// ordered by number then ID.
+func (b *BlockCache) Keys(from, to uint64) []BlockKey {
+	c := b.cache
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := c.now()
+	var keys []BlockKey
+	for _, key := range c.blocks.between(from, to) {
+		if !c.index[key.String()].expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// ReadRange returns the blocks cached between from and to inclusively, ordered
+// by number then ID. Blocks evicted while the range is read are skipped.
+func (b *BlockCache) ReadRange(from, to uint64) ([]Block, error) {
+	var blocks []Block
+	for _, key := range b.Keys(from, to) {
+		data, found, err := b.Read(key)
+		if err != nil {
+			return nil, fmt.Errorf("reading block %s: %w", key, err)
+		}
+		if found {
+			blocks = append(blocks, Block{Key: key, Data: data})
+		}
+	}
+
+	return blocks, nil
+}
+
+// blockIndex keeps the block keys of the cache index ordered, it is only
+// maintained once a BlockCache wraps the cache. Block numbers are held in a
+// treap, so updates are logarithmic whatever the order blocks are written or
+// evicted in, and the IDs of each number in a sorted slice, forks being rare.
+type blockIndex struct {
+	root  *blockNode
+	ids   map[uint64][]string
+	count int
+}
+
+func newBlockIndex() *blockIndex {
+	return &blockIndex{ids: map[uint64][]string{}}
+}
+
+// add indexes key when it is a block key, a nil index holds nothing.
+func (b *blockIndex) add(key string) {
+	if b == nil {
+		return
+	}
+
+	blockKey, err := ParseBlockKey(key)
+	if err != nil {
+		return
+	}
+
+	ids, found := b.ids[blockKey.Num]
+	i := sort.SearchStrings(ids, blockKey.ID)
+	if i < len(ids) && ids[i] == blockKey.ID {
+		return
+	}
+	if !found {
+		b.root = b.root.insert(blockKey.Num)
+	}
+
+	ids = append(ids, "")
+	copy(ids[i+1:], ids[i:])
+	ids[i] = blockKey.ID
+	b.ids[blockKey.Num] = ids
+	b.count++
+}
+
+func (b *blockIndex) remove(key string) {
+	if b == nil {
+		return
+	}
+
+	blockKey, err := ParseBlockKey(key)
+	if err != nil {
+		return
+	}
+
+	ids := b.ids[blockKey.Num]
+	i := sort.SearchStrings(ids, blockKey.ID)
+	if i == len(ids) || ids[i] != blockKey.ID {
+		return
+	}
+
+	b.count--
+	if len(ids) == 1 {
+		delete(b.ids, blockKey.Num)
+		b.root = b.root.remove(blockKey.Num)
+		return
+	}
+	b.ids[blockKey.Num] = append(ids[:i], ids[i+1:]...)
+}
+
+// between returns the keys numbered from from to to inclusively.
+func (b *blockIndex) between(from, to uint64) (keys []BlockKey) {
+	if b == nil || from > to {
+		return nil
+	}
+
+	b.root.walk(from, to, func(num uint64) {
+		for _, id := range b.ids[num] {
+			keys = append(keys, BlockKey{Num: num, ID: id})
+		}
+	})
+	return keys
+}
+
+// withIDs returns the keys having one of ids, in no particular order.
+func (b *blockIndex) withIDs(ids map[string]bool) (keys []BlockKey) {
+	if b == nil {
+		return nil
+	}
+
+	for num, numIDs := range b.ids {
+		for _, id := range numIDs {
+			if ids[id] {
+				keys = append(keys, BlockKey{Num: num, ID: id})
+			}
+		}
+	}
+	return keys
+}
+
+// blockNode is a node of a treap of block numbers, ordered by number and
+// heap-ordered by a priority derived from the number.
+type blockNode struct {
+	num         uint64
+	priority    uint64
+	left, right *blockNode
+}
+
+// blockPriority scrambles num with the splitmix64 finalizer, so the treap of
+// sequential block numbers stays balanced.
+func blockPriority(num uint64) uint64 {
+	num += 0x9E3779B97F4A7C15
+	num = (num ^ (num >> 30)) * 0xBF58476D1CE4E5B9
+	num = (num ^ (num >> 27)) * 0x94D049BB133111EB
+	return num ^ (num >> 31)
+}
+
+func (n *blockNode) insert(num uint64) *blockNode {
+	if n == nil {
+		return &blockNode{num: num, priority: blockPriority(num)}
+	}
+
+	if num < n.num {
+		n.left = n.left.insert(num)
+		if n.left.priority > n.priority {
+			return n.rotateRight()
+		}
+	} else {
+		n.right = n.right.insert(num)
+		if n.right.priority > n.priority {
+			return n.rotateLeft()
+		}
+	}
+	return n
+}
+
+func (n *blockNode) remove(num uint64) *blockNode {
+	switch {
+	case n == nil:
+		return nil
+	case num < n.num:
+		n.left = n.left.remove(num)
+	case num > n.num:
+		n.right = n.right.remove(num)
+	default:
+		return mergeBlockNodes(n.left, n.right)
+	}
+	return n
+}
+
+// mergeBlockNodes joins two treaps, every number of left being lower than the
+// numbers of right.
+func mergeBlockNodes(left, right *blockNode) *blockNode {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+
+	if left.priority > right.priority {
+		left.right = mergeBlockNodes(left.right, right)
+		return left
+	}
+	right.left = mergeBlockNodes(left, right.left)
+	return right
+}
+
+func (n *blockNode) rotateRight() *blockNode {
+	left := n.left
+	n.left = left.right
+	left.right = n
+	return left
+}
+
+func (n *blockNode) rotateLeft() *blockNode {
+	right := n.right
+	n.right = right.left
+	right.left = n
+	return right
+}
+
+// walk visits in order the numbers from from to to inclusively.
+func (n *blockNode) walk(from, to uint64, visit func(num uint64)) {
+	if n == nil {
+		return
+	}
+
+	if from < n.num {
+		n.left.walk(from, to, visit)
+	}
+	if from <= n.num && n.num <= to {
+		visit(n.num)
+	}
+	if n.num < to {
+		n.right.walk(from, to, visit)
+	}
+}
@@ -0,0 +1,139 @@
+package atm
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBlockKey(t *testing.T) {
+	key, err := ParseBlockKey(BlockKey{Num: 42, ID: "00ab.cd"}.String())
+	require.NoError(t, err)
+	require.Equal(t, BlockKey{Num: 42, ID: "00ab.cd"}, key)
+
+	for _, invalid := range []string{"42", "abc.00ab", "042.00ab", "-1.00ab", ""} {
+		_, err := ParseBlockKey(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestBlockCache_Range(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	cache := NewCache("/cache", 7, 0, store)
+	defer cache.Close(context.Background())
+
+	_, err := cache.Write("not-a-block", ttime(20), ttime(20), []byte("1"))
+	require.NoError(t, err)
+
+	blocks := NewBlockCache(cache)
+	write := func(num uint64, id string) {
+		t.Helper()
+		_, err := blocks.Write(BlockKey{Num: num, ID: id}, ttime(int(num)), ttime(int(num)), []byte(id))
+		require.NoError(t, err)
+	}
+
+	write(12, "c")
+	write(10, "a")
+	write(11, "b")
+	write(11, "a") // forked
+	write(14, "e")
+
+	require.Equal(t, []BlockKey{{10, "a"}, {11, "a"}, {11, "b"}, {12, "c"}, {14, "e"}}, blocks.Keys(0, 100))
+	require.Equal(t, []BlockKey{{11, "a"}, {11, "b"}, {12, "c"}}, blocks.Keys(11, 13))
+	require.Empty(t, blocks.Keys(15, 20))
+	require.Empty(t, blocks.Keys(12, 11))
+
+	read, err := blocks.ReadRange(12, 14)
+	require.NoError(t, err)
+	require.Equal(t, []Block{{Key: BlockKey{12, "c"}, Data: []byte("c")}, {Key: BlockKey{14, "e"}, Data: []byte("e")}}, read)
+
+	// Evicted and deleted blocks leave the index
+	write(15, "ff")
+	require.NotContains(t, blocks.Keys(0, 100), BlockKey{10, "a"})
+	_, err = cache.Delete(BlockKey{Num: 11, ID: "b"}.String())
+	require.NoError(t, err)
+	require.Equal(t, len(cache.index)-1, cache.blocks.count)
+	require.NotContains(t, blocks.Keys(0, 100), BlockKey{11, "b"})
+}
+
+func TestBlockCache_IndexesExistingItems(t *testing.T) {
+	basePath := t.TempDir()
+	cache, err := NewInitializedCache(basePath, 10_000, 10_000, NewFileIO())
+	require.NoError(t, err)
+
+	blocks := NewBlockCache(cache)
+	for num := uint64(1); num <= 3; num++ {
+		_, err := blocks.Write(BlockKey{Num: num, ID: "id"}, ttime(int(num)), ttime(int(num)), []byte("data"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, cache.Close(context.Background()))
+
+	reopened, err := NewInitializedCache(basePath, 10_000, 10_000, NewFileIO())
+	require.NoError(t, err)
+	defer reopened.Close(context.Background())
+
+	require.Equal(t, []BlockKey{{2, "id"}, {3, "id"}}, NewBlockCache(reopened).Keys(2, 10))
+}
+
+func TestBlockIndex(t *testing.T) {
+	index := newBlockIndex()
+	expected := map[BlockKey]bool{}
+	random := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 5000; i++ {
+		key := BlockKey{Num: uint64(random.Intn(500)), ID: string(rune('a' + random.Intn(3)))}
+		if random.Intn(3) == 0 {
+			index.remove(key.String())
+			delete(expected, key)
+		} else {
+			index.add(key.String())
+			expected[key] = true
+		}
+	}
+
+	var keys []BlockKey
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Num != keys[j].Num {
+			return keys[i].Num < keys[j].Num
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	require.Equal(t, len(keys), index.count)
+	require.Equal(t, keys, index.between(0, 1000))
+
+	var ranged []BlockKey
+	for _, key := range keys {
+		if key.Num >= 100 && key.Num <= 200 {
+			ranged = append(ranged, key)
+		}
+	}
+	require.Equal(t, ranged, index.between(100, 200))
+}
+
+func BenchmarkBlockCache_WriteWithEviction(b *testing.B) {
+	SystemBlockSize = 0
+	const cached = 500_000
+	cache := NewCache("/cache", cached, 0, NewMemoryIO())
+	defer cache.Close(context.Background())
+
+	blocks := NewBlockCache(cache)
+	for num := 0; num < cached; num++ {
+		_, err := blocks.Write(BlockKey{Num: uint64(num), ID: "id"}, ttime(num), ttime(num), []byte{1})
+		require.NoError(b, err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		num := cached + i
+		_, err := blocks.Write(BlockKey{Num: uint64(num), ID: "id"}, ttime(num), ttime(num), []byte{1})
+		require.NoError(b, err)
+	}
+}
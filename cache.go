@@ -1,13 +1,16 @@
 package atm
 
 import (
-	"container/heap"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
-	"strings"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -17,73 +20,239 @@ import (
 var SystemBlockSize = 4 * 1024 // 4K blocks by default, to estimate cache overhead
 const DateFormat = "20060102T1504059999"
 
+// ErrClosed is returned by cache operations once Close has been called.
+var ErrClosed = errors.New("cache closed")
+
 type Cache struct {
 	basePath string
 
-	index           map[string]*CacheItem
-	recentEntryHeap *Heap
-	ageHeap         *Heap
+	index  map[string]*CacheItem
+	policy EvictionPolicy
+	// expiryHeap holds the items written with a TTL, soonest to expire first
+	expiryHeap *Heap
+	// trackAccess is set when reads are reported to the eviction policy
+	trackAccess bool
+
+	// pinned items are not tracked by the eviction policy
+	pinnedCount    int
+	pinnedBytes    int
+	maxPinnedBytes int
 
 	mu      sync.RWMutex
 	cacheIO CacheIO
+	codec   Codec
+	closed  bool
+
+	memory    *memoryTier
+	admission *countMinSketch
+	blocks    *blockIndex
+	// reversible holds the items written with Reversible, by insertion time
+	reversible *Heap
+
+	loads loadGroup
+
+	listenersMu    sync.RWMutex
+	listeners      [eventKindCount][]subscription
+	nextListenerID uint64
+	pendingEvents  []event
+
+	done      chan struct{}
+	loops     sync.WaitGroup
+	deletions sync.WaitGroup
+
+	stats *cacheStats
+
+	manifestCheckpointInterval time.Duration
+	expirationInterval         time.Duration
+	accessOrder                bool
+
+	now func() time.Time
+}
+
+func NewCache(basePath string, maxRecentEntryBytes, maxEntryByAgeBytes int, cacheIO CacheIO, opts ...Option) *Cache {
+	c := newCache(basePath, maxRecentEntryBytes, maxEntryByAgeBytes, cacheIO, opts...)
+	c.start()
+
+	return c
 }
 
-func NewCache(basePath string, maxRecentEntryBytes, maxEntryByAgeBytes int, cacheIO CacheIO) *Cache {
+// NewInitializedCache creates a cache indexing the items already stored in
+// basePath. When initialization fails, the partially initialized cache is
+// returned along with the error, without its background routines started.
+func NewInitializedCache(basePath string, maxRecentEntryBytes, maxEntryByAgeBytes int, cacheIO CacheIO, opts ...Option) (*Cache, error) {
+	opts = append([]Option{WithManifestCheckpointInterval(DefaultManifestCheckpointInterval)}, opts...)
+	c := newCache(basePath, maxRecentEntryBytes, maxEntryByAgeBytes, cacheIO, opts...)
+
+	c, err := c.initialize()
+	if err != nil {
+		return c, err
+	}
+	c.start()
+
+	return c, nil
+}
+
+func newCache(basePath string, maxRecentEntryBytes, maxEntryByAgeBytes int, cacheIO CacheIO, opts ...Option) *Cache {
 	c := &Cache{
-		basePath:        basePath,
-		index:           map[string]*CacheItem{},
-		recentEntryHeap: NewHeap(ByInsertionTime, maxRecentEntryBytes),
-		ageHeap:         NewHeap(ByAge, maxEntryByAgeBytes),
-		cacheIO:         cacheIO,
+		basePath:   basePath,
+		index:      map[string]*CacheItem{},
+		policy:     NewRecentAgePolicy(maxRecentEntryBytes, maxEntryByAgeBytes),
+		expiryHeap: NewHeap(ByExpiration, 0),
+		cacheIO:    cacheIO,
+		codec:      NoCompression,
+		done:       make(chan struct{}),
+		stats:      newCacheStats(),
+
+		expirationInterval: DefaultExpirationInterval,
+		now:                time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if policy, ok := c.policy.(*RecentAgePolicy); ok && c.accessOrder {
+		policy.orderByAccess()
+	}
+
+	c.trackAccess = c.accessOrder
+	if policy, ok := c.policy.(accessIgnorer); !ok || !policy.ignoresAccess() {
+		c.trackAccess = true
 	}
 
-	heap.Init(c.ageHeap)
-	heap.Init(c.recentEntryHeap)
+	return c
+}
 
+// start launches the background routines of the cache, they are stopped by
+// Close.
+func (c *Cache) start() {
+	c.runLoop(func() { c.logStatsLoop(10 * time.Second) })
+
+	if c.manifestCheckpointInterval > 0 {
+		c.runLoop(c.checkpointLoop)
+	}
+
+	if c.expirationInterval > 0 {
+		c.runLoop(c.expireLoop)
+	}
+}
+
+func (c *Cache) runLoop(loop func()) {
+	c.loops.Add(1)
 	go func() {
-		for {
-			select {
-			case <-time.After(10 * time.Second):
-				zlog.Info("cache stats",
-					zap.Int("count_indexes", len(c.index)),
-					zap.Int("count_recent entries", c.recentEntryHeap.Len()),
-					zap.Int("count_age entries", c.ageHeap.Len()),
-					zap.String("size_recent_heap", humanize.Bytes(uint64(c.recentEntryHeap.sizeInBytes))),
-					zap.String("size_age_heap", humanize.Bytes(uint64(c.ageHeap.sizeInBytes))),
-				)
-			}
-		}
+		defer c.loops.Done()
+		loop()
 	}()
+}
 
-	return c
+func (c *Cache) logStatsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			stats := c.Stats()
+			zlog.Info("cache stats",
+				zap.Int("count_indexes", stats.ItemCount),
+				zap.Int("count_recent entries", stats.RecentEntryCount),
+				zap.Int("count_age entries", stats.AgeCount),
+				zap.String("size_recent_heap", humanize.Bytes(uint64(stats.RecentEntryBytes))),
+				zap.String("size_age_heap", humanize.Bytes(uint64(stats.AgeBytes))),
+				zap.Uint64("hits", stats.Hits),
+				zap.Uint64("misses", stats.Misses),
+			)
+		}
+	}
 }
 
-func NewInitializedCache(basePath string, maxRecentEntryBytes, maxEntryByAgeBytes int, cacheIO CacheIO) (*Cache, error) {
-	c := NewCache(basePath, maxRecentEntryBytes, maxEntryByAgeBytes, cacheIO)
+// Close stops the background routines of the cache and waits for pending
+// file deletions to complete, or for ctx to be done. Every later operation on
+// the cache returns ErrClosed. Close can be called again, for example after
+// ctx expired, to keep waiting for the pending deletions.
+func (c *Cache) Close(ctx context.Context) error {
+	c.mu.Lock()
+	firstClose := !c.closed
+	if firstClose {
+		c.closed = true
+		close(c.done)
+	}
+	c.mu.Unlock()
+
+	c.memory.clear()
+
+	// A checkpoint running in the background must not replace the final one
+	c.loops.Wait()
+
+	if firstClose && c.manifestCheckpointInterval > 0 {
+		if err := c.checkpoint(); err != nil {
+			zlog.Warn("failed to checkpoint cache manifest on close", zap.Error(err))
+		}
+	}
+
+	deleted := make(chan struct{})
+	go func() {
+		c.deletions.Wait()
+		close(deleted)
+	}()
 
-	return c.initialize()
+	select {
+	case <-deleted:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for pending deletions: %w", ctx.Err())
+	}
 }
 
+// initialize rebuilds the index from the manifest, when present, then indexes
+// the files of basePath that were added since the last checkpoint.
 func (c *Cache) initialize() (*Cache, error) {
 	zlog.Info("initializing cache", zap.String("base_cache_path", c.basePath))
 	c.index = map[string]*CacheItem{}
 
-	files, err := ioutil.ReadDir(c.basePath)
+	fileInfos, err := ioutil.ReadDir(c.basePath)
 	if err != nil {
 		return c, fmt.Errorf("listing file of folder: %s : %w", c.basePath, err)
 	}
 
-	zlog.Info("load files to caches", zap.Int("file_count", len(files)))
-	for _, f := range files {
-		if f.IsDir() {
+	files := make(map[string]os.FileInfo, len(fileInfos))
+	for _, f := range fileInfos {
+		if f.IsDir() || f.Name() == ManifestFileName {
+			continue
+		}
+
+		if isTempFileName(f.Name()) {
+			zlog.Info("removing leftover temp file", zap.String("file", f.Name()))
+			if err := os.Remove(path.Join(c.basePath, f.Name())); err != nil {
+				zlog.Warn("failed to remove leftover temp file", zap.String("file", f.Name()), zap.Error(err))
+			}
 			continue
 		}
-		_, cacheItem, err := cacheItemFromFile(path.Join(c.basePath, f.Name()), f)
+		files[f.Name()] = f
+	}
+
+	renamed := migrateLegacyFiles(c.basePath, files)
+
+	if err := c.restoreFromManifest(files, renamed); err != nil {
+		zlog.Warn("unable to restore cache from manifest, indexing every file", zap.Error(err))
+	}
+
+	zlog.Info("load files to caches", zap.Int("file_count", len(files)))
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		_, cacheItem, err := cacheItemFromFile(path.Join(c.basePath, name), files[name])
 		if err != nil {
 			zlog.Debug("skipping invalid cache file", zap.Error(err))
 			continue
 		}
-		_, err = c.write(cacheItem, []byte{}, true)
+		_, err = c.write(cacheItem, 0, nil)
 		if err != nil {
 			return c, fmt.Errorf("writing cache item: %w", err)
 		}
@@ -93,138 +262,390 @@ func (c *Cache) initialize() (*Cache, error) {
 }
 
 func (c *Cache) toFilePath(key string, t time.Time) string {
-	return toFilePath(c.basePath, key, t)
+	return path.Join(c.basePath, encodeFileName(key, t, c.codec.Name()))
 }
 
 func toFilePath(basePath, key string, t time.Time) string {
-	name := fmt.Sprintf("%s-%s", key, t.Format(DateFormat))
-	return path.Join(basePath, name)
+	return path.Join(basePath, encodeFileName(key, t, ""))
 }
 
 func sizeOnDisk(dataLen int) int {
 	return dataLen + SystemBlockSize
 }
 
-func (c *Cache) Write(key string, itemDate time.Time, insertionDate time.Time, data []byte) (*CacheItem, error) {
+func (c *Cache) Write(key string, itemDate time.Time, insertionDate time.Time, data []byte, opts ...WriteOption) (*CacheItem, error) {
+	encoded, err := encode(c.codec, data)
+	if err != nil {
+		return nil, fmt.Errorf("encoding with %s: %w", c.codec.Name(), err)
+	}
+
 	filePath := c.toFilePath(key, itemDate)
-	item := newCacheItem(key, filePath, sizeOnDisk(len(data)), itemDate, insertionDate)
+	item := newCacheItem(key, filePath, sizeOnDisk(len(encoded)), itemDate, insertionDate)
+	item.codec = c.codec
+	item.setChecksum(checksumOf(encoded))
+	newWriteOptions(opts).apply(item, c.now())
+
+	stored, err := c.write(item, len(encoded), func() error {
+		defer c.stats.observe(ioWrite, time.Now())
+		return c.cacheIO.Write(filePath, encoded)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return c.write(item, data, false)
+	if stored == item {
+		c.populateMemory(item, data)
+	}
+
+	return stored, nil
 }
 
-func (c *Cache) write(cacheItem *CacheItem, data []byte, skipWriteToFile bool) (*CacheItem, error) {
+// WriteFrom streams the content of reader to the CacheIO and inserts the
+// resulting item. The item size is accounted from the encoded bytes actually
+// streamed, so the payload never needs to be held in memory. When key is already cached,
+// reader is not consumed.
+func (c *Cache) WriteFrom(key string, itemDate time.Time, insertionDate time.Time, reader io.Reader, opts ...WriteOption) (*CacheItem, error) {
+	item, found, err := c.touch(key, insertionDate)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return item, nil
+	}
+
+	encoded := encodingReader(c.codec, reader)
+	defer encoded.Close()
+
+	filePath := c.toFilePath(key, itemDate)
+	checksum := newChecksumHash()
+	start := time.Now()
+	written, err := c.cacheIO.WriteFrom(filePath, io.TeeReader(encoded, checksum))
+	c.stats.observe(ioWrite, start)
+	if err != nil {
+		return nil, fmt.Errorf("streaming file: %w", err)
+	}
+	zlog.Debug("streamed file", zap.String("path", filePath), zap.Int64("written", written))
+
+	item = newCacheItem(key, filePath, sizeOnDisk(int(written)), itemDate, insertionDate)
+	item.codec = c.codec
+	item.setChecksum(checksum.Sum32())
+	newWriteOptions(opts).apply(item, c.now())
+	stored, err := c.write(item, int(written), nil)
+	if err != nil {
+		if deleteErr := c.cacheIO.Delete(filePath); deleteErr != nil {
+			zlog.Warn("failed to delete streamed file", zap.String("file", filePath), zap.Error(deleteErr))
+		}
+		return nil, err
+	}
+
+	if stored != item && stored.filePath != item.filePath { //a concurrent write won the race under another path
+		if err := c.cacheIO.Delete(item.filePath); err != nil {
+			zlog.Warn("failed to delete duplicated streamed file", zap.String("file", item.filePath), zap.Error(err))
+		}
+	}
+
+	return stored, nil
+}
+
+func (c *Cache) touch(key string, insertionDate time.Time) (*CacheItem, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, false, ErrClosed
+	}
+
+	item, found := c.index[key]
+	if !found || item.expired(c.now()) {
+		return nil, false, nil
+	}
+
+	c.touchWithLock(item, insertionDate)
+	return item, true, nil
+}
+
+// write inserts cacheItem, making room for dataLen bytes in the heaps. When
+// writeFile is not nil, it is called to persist the data before anything is
+// evicted or indexed.
+func (c *Cache) write(cacheItem *CacheItem, dataLen int, writeFile func() error) (*CacheItem, error) {
+	defer c.dispatchEvents()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.closed {
+		return nil, ErrClosed
+	}
+
 	zlog.Debug("writing cache item", zap.Stringer("item", cacheItem))
 
-	if item, ok := c.index[cacheItem.key]; ok {
-		item.insertedAt = cacheItem.insertedAt
+	// An expired item is replaced, its file is kept when overwritten by the new one
+	cacheItem.reversible = cacheItem.reversible && c.reversible != nil
+
+	item, found := c.index[cacheItem.key]
+	if found && !item.expired(c.now()) {
+		c.touchWithLock(item, cacheItem.insertedAt)
 		return item, nil
 	}
 
-	evictedCacheItems := c.purgeWithLock(c.recentEntryHeap, len(data))
-	if len(evictedCacheItems) > 0 {
-		zlog.Debug("evicted from recent entry heap", zap.Reflect("items", evictedCacheItems))
+	if !c.admitWithLock(cacheItem, dataLen) {
+		atomic.AddUint64(&c.stats.rejections, 1)
+		zlog.Debug("cache item not admitted", zap.Stringer("item", cacheItem))
+		return nil, ErrNotAdmitted
 	}
 
-	for _, evicted := range evictedCacheItems {
-		if c.ageHeap.FreeSpace() >= evicted.size { //we need space
-			heap.Push(c.ageHeap, evicted)
-			continue
-		}
-
-		peek := c.ageHeap.Peek()
-		if peek.itemDate.Before(evicted.itemDate) { //evicted item is older then last age item so we remove it
-			evictedAgeItems := c.purgeWithLock(c.ageHeap, len(data))
-			for _, ageEvicted := range evictedAgeItems {
-				delete(c.index, ageEvicted.key)
-				go func(toDelete *CacheItem) {
-					err := c.cacheIO.Delete(toDelete.filePath)
-					if err != nil {
-						zlog.Warn("failed to delete file", zap.String("file", toDelete.filePath), zap.Error(err))
-					}
-				}(ageEvicted)
-			}
-			heap.Push(c.ageHeap, evicted)
-		} else {
-			delete(c.index, evicted.key)
-			go func(toDelete *CacheItem) {
-				err := c.cacheIO.Delete(toDelete.filePath)
-				if err != nil {
-					zlog.Warn("too old to age heap : failed to delete file", zap.String("file", toDelete.filePath), zap.Error(err))
-				}
-			}(evicted)
-		}
+	var expired *CacheItem
+	if found {
+		expired = c.removeWithLock(item.key)
+		atomic.AddUint64(&c.stats.expirations, 1)
+		c.emitWithLock(eventEvict, expired, ReasonExpired)
 	}
 
-	if !skipWriteToFile {
-		err := c.cacheIO.Write(cacheItem.filePath, data)
+	// The file is written before making room for it, so a failed write leaves
+	// the cache untouched
+	if writeFile != nil {
+		err := writeFile()
 		if err != nil {
+			if expired != nil {
+				c.deleteFileAsync(expired, ReasonExpired)
+			}
 			return nil, fmt.Errorf("writing file: %w", err)
 		}
 		zlog.Debug("wrote file", zap.String("path", cacheItem.filePath))
 	}
+	if expired != nil && expired.filePath != cacheItem.filePath {
+		c.deleteFileAsync(expired, ReasonExpired)
+	}
+
+	c.trackWithLock(cacheItem, dataLen)
 
 	c.index[cacheItem.key] = cacheItem
-	heap.Push(c.recentEntryHeap, cacheItem)
+	c.blocks.add(cacheItem.key)
+	c.trackExpiryWithLock(cacheItem)
+	c.emitWithLock(eventInsert, cacheItem, ReasonWrite)
 
 	return cacheItem, nil
 }
 
-func (c *Cache) purgeWithLock(h *Heap, neededSpace int) (evictedCacheItems []*CacheItem) { //this func should always be call within a cache lock
-	freeSpace := h.FreeSpace()
-	if freeSpace >= neededSpace {
-		return
-	}
+// dropWithLock removes an item the eviction policy let go of from the index
+// and deletes its backing file in the background.
+func (c *Cache) dropWithLock(cacheItem *CacheItem, reason EventReason) { //this func should always be call within a cache lock
+	delete(c.index, cacheItem.key)
+	c.blocks.remove(cacheItem.key)
+	c.memory.remove(cacheItem.key)
+	c.expiryHeap.Remove(cacheItem.key)
+	c.emitWithLock(eventEvict, cacheItem, reason)
+	c.deleteFileAsync(cacheItem, reason)
+}
 
-	for freeSpace < neededSpace {
-		evicted := c.evictWithLock(h)
-		if evicted == nil {
-			return
-		}
+// Read returns the data of key. When the data read back does not match the
+// checksum computed at write time, the entry is evicted and an error wrapping
+// ErrCorrupted is returned.
+func (c *Cache) Read(key string) (data []byte, found bool, err error) {
+	c.recordLookup(key)
 
-		evictedCacheItems = append(evictedCacheItems, evicted)
-		freeSpace = h.FreeSpace()
+	if data, found := c.readMemoryCopy(key); found {
+		return data, true, nil
 	}
 
-	return
-}
+	cacheItem, data, found, err := c.read(key)
+	if err != nil || !found {
+		return nil, found, err
+	}
 
-func (c *Cache) evictWithLock(h *Heap) *CacheItem {
-	removed := heap.Pop(h)
-	if removed == nil {
-		return nil
+	if !cacheItem.verify(checksumOf(data)) {
+		c.evictCorrupted(cacheItem)
+		return nil, false, corruptedError(cacheItem)
+	}
+
+	data, err = decode(cacheItem.codec, data)
+	if err != nil {
+		return nil, true, fmt.Errorf("decoding %q with %s: %w", key, cacheItem.codec.Name(), err)
 	}
 
-	return removed.(*CacheItem)
+	c.populateMemory(cacheItem, data)
+	c.recordAccess(cacheItem)
+	return data, true, nil
 }
 
-func (c *Cache) Read(key string) (data []byte, found bool, err error) {
+func (c *Cache) read(key string) (cacheItem *CacheItem, data []byte, found bool, err error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	var cacheItem *CacheItem
-	if cacheItem, found = c.index[key]; !found {
+	if c.closed {
+		err = ErrClosed
 		return
 	}
 
+	if cacheItem, found = c.index[key]; !found || cacheItem.expired(c.now()) {
+		atomic.AddUint64(&c.stats.misses, 1)
+		return nil, nil, false, nil
+	}
+	atomic.AddUint64(&c.stats.hits, 1)
+
 	zlog.Debug("reading cache item", zap.Stringer("item", cacheItem))
 
+	start := time.Now()
 	data, err = c.cacheIO.Read(cacheItem.filePath)
+	c.stats.observe(ioRead, start)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// OpenReader opens the data of key for streaming reads. The caller is
+// responsible for closing the returned reader. The checksum is verified once
+// the reader is exhausted, the final Read returning an error wrapping
+// ErrCorrupted instead of io.EOF on mismatch.
+func (c *Cache) OpenReader(key string) (reader io.ReadCloser, found bool, err error) {
+	c.recordLookup(key)
+
+	if reader, found := c.openMemoryReader(key); found {
+		return reader, true, nil
+	}
+
+	cacheItem, reader, found, err := c.openReader(key)
+	if err != nil || !found {
+		return reader, found, err
+	}
+
+	if cacheItem.checksummed {
+		reader = &verifyingReader{ReadCloser: reader, cache: c, cacheItem: cacheItem, hash: newChecksumHash()}
+	}
+
+	decoded, err := decodingReader(cacheItem.codec, reader)
 	if err != nil {
+		reader.Close()
+		return nil, true, fmt.Errorf("decoding %q with %s: %w", key, cacheItem.codec.Name(), err)
+	}
+
+	c.recordAccess(cacheItem)
+	return decoded, true, nil
+}
+
+func (c *Cache) openReader(key string) (cacheItem *CacheItem, reader io.ReadCloser, found bool, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		err = ErrClosed
 		return
 	}
 
+	if cacheItem, found = c.index[key]; !found || cacheItem.expired(c.now()) {
+		atomic.AddUint64(&c.stats.misses, 1)
+		return nil, nil, false, nil
+	}
+	atomic.AddUint64(&c.stats.hits, 1)
+
+	zlog.Debug("opening cache item reader", zap.Stringer("item", cacheItem))
+
+	start := time.Now()
+	reader, err = c.cacheIO.OpenReader(cacheItem.filePath)
+	c.stats.observe(ioRead, start)
 	return
 }
 
+// Delete removes key from the cache and deletes its backing file through the
+// CacheIO. It returns false when the key was not cached.
+func (c *Cache) Delete(key string) (bool, error) {
+	removed, err := c.InvalidateKeys(key)
+	return removed > 0, err
+}
+
+// InvalidateKeys removes every given key from the cache, deleting the backing
+// files through the CacheIO. Keys that are not cached are ignored. It returns
+// how many entries were removed, the first file deletion error is returned
+// after all keys have been processed.
+func (c *Cache) InvalidateKeys(keys ...string) (removed int, err error) {
+	defer c.dispatchEvents()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, ErrClosed
+	}
+
+	removed, _, err = c.invalidateWithLock(keys, ReasonExplicit)
+	return
+}
+
+// invalidateWithLock removes keys from the cache, deleting their files before
+// returning. It returns how many entries and bytes were removed.
+func (c *Cache) invalidateWithLock(keys []string, reason EventReason) (removed int, removedBytes int, err error) { //this func should always be call within a cache lock
+	for _, key := range keys {
+		cacheItem := c.removeWithLock(key)
+		if cacheItem == nil {
+			continue
+		}
+		removed++
+		removedBytes += cacheItem.size
+
+		zlog.Debug("invalidated cache item", zap.Stringer("item", cacheItem), zap.Stringer("reason", reason))
+		c.emitWithLock(eventEvict, cacheItem, reason)
+
+		if deleteErr := c.deleteFileWithLock(cacheItem, reason); deleteErr != nil && err == nil {
+			err = deleteErr
+		}
+	}
+
+	return
+}
+
+// deleteFileWithLock deletes the backing file of an item removed from the
+// index. Holding the lock keeps the deletion from landing after the same key
+// was written again to the same path.
+func (c *Cache) deleteFileWithLock(cacheItem *CacheItem, reason EventReason) error { //this func should always be call within a cache lock
+	start := time.Now()
+	err := c.cacheIO.Delete(cacheItem.filePath)
+	c.stats.observe(ioDelete, start)
+	if err != nil {
+		atomic.AddUint64(&c.stats.deleteFailures, 1)
+		return fmt.Errorf("deleting file %s: %w", cacheItem.filePath, err)
+	}
+
+	c.emitWithLock(eventDelete, cacheItem, reason)
+	return nil
+}
+
+func (c *Cache) removeWithLock(key string) *CacheItem { //this func should always be call within a cache lock
+	cacheItem, found := c.index[key]
+	if !found {
+		return nil
+	}
+
+	delete(c.index, key)
+	c.blocks.remove(key)
+	c.memory.remove(key)
+	c.expiryHeap.Remove(key)
+	if cacheItem.pinned {
+		c.releasePinWithLock(cacheItem)
+	} else {
+		c.untrackWithLock(cacheItem)
+	}
+
+	return cacheItem
+}
+
 type CacheItem struct {
 	key        string
 	size       int
 	itemDate   time.Time
 	insertedAt time.Time
-	filePath   string
+	// lastAccessedAt is the insertion date until the item is read, it is only
+	// maintained when the recent entry heap is ordered by access time
+	lastAccessedAt time.Time
+	expiresAt      time.Time
+	filePath       string
+	pinned         bool
+	reversible     bool
+
+	codec       Codec
+	checksum    uint32
+	checksummed bool
 }
 
 func newCacheItem(key string, filePath string, size int, itemDate, insertedAt time.Time) *CacheItem {
@@ -234,25 +655,60 @@ func newCacheItem(key string, filePath string, size int, itemDate, insertedAt ti
 		size:       size,
 		itemDate:   itemDate,
 		insertedAt: insertedAt,
+		codec:      NoCompression,
+
+		lastAccessedAt: insertedAt,
 	}
 }
 
+func (i *CacheItem) Key() string {
+	return i.key
+}
+
+func (i *CacheItem) Size() int {
+	return i.size
+}
+
+func (i *CacheItem) ItemDate() time.Time {
+	return i.itemDate
+}
+
+func (i *CacheItem) InsertedAt() time.Time {
+	return i.insertedAt
+}
+
+// ExpiresAt returns when the item expires, the zero time when it was written
+// without TTL.
+func (i *CacheItem) ExpiresAt() time.Time {
+	return i.expiresAt
+}
+
+func (i *CacheItem) FilePath() string {
+	return i.filePath
+}
+
+// Pinned reports whether the item was protected from eviction with Pin.
+func (i *CacheItem) Pinned() bool {
+	return i.pinned
+}
+
 func (i *CacheItem) String() string {
 	return fmt.Sprintf("key: %s, size: %d: item date: %s, inserted at: %s, path: %s", i.key, i.size, i.itemDate, i.insertedAt, i.filePath)
 }
 
 func cacheItemFromFile(filePath string, fileInfo os.FileInfo) (key string, item *CacheItem, err error) {
-	parts := strings.Split(fileInfo.Name(), "-")
-	if len(parts) != 2 {
-		return "", nil, fmt.Errorf("invalid file name, expected 3 parts got %d", len(parts))
-	}
-	key = parts[0]
-	t, err := time.Parse(DateFormat, parts[1])
+	key, t, codecName, _, err := decodeFileName(fileInfo.Name())
 	if err != nil {
 		return "", nil, err
 	}
 
+	codec, err := codecByName(codecName)
+	if err != nil {
+		return "", nil, fmt.Errorf("file %s: %w", fileInfo.Name(), err)
+	}
+
 	item = newCacheItem(key, filePath, int(fileInfo.Size()), t, fileInfo.ModTime())
+	item.codec = codec
 
 	return
 }
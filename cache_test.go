@@ -1,33 +1,74 @@
 package atm
 
 import (
+	"bytes"
 	"container/heap"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"runtime"
 	"sort"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 type testCacheIO struct {
-	writeFunc  func(path string, data []byte) error
-	readFunc   func(path string) ([]byte, error)
-	deleteFunc func(path string) error
+	writeFunc      func(path string, data []byte) error
+	readFunc       func(path string) ([]byte, error)
+	deleteFunc     func(path string) error
+	writeFromFunc  func(path string, reader io.Reader) (int64, error)
+	openReaderFunc func(path string) (io.ReadCloser, error)
 }
 
+// newTestCacheIO returns a testCacheIO keeping written data in memory, every
+// func can be replaced to observe or alter the calls.
 func newTestCacheIO() *testCacheIO {
+	lock := sync.Mutex{}
+	files := map[string][]byte{}
+
 	return &testCacheIO{
 		writeFunc: func(path string, data []byte) error {
+			lock.Lock()
+			defer lock.Unlock()
+			files[path] = data
 			return nil
 		},
 		readFunc: func(path string) ([]byte, error) {
-			return nil, nil
+			lock.Lock()
+			defer lock.Unlock()
+			return files[path], nil
 		},
 		deleteFunc: func(path string) error {
+			lock.Lock()
+			defer lock.Unlock()
+			delete(files, path)
 			return nil
 		},
+		writeFromFunc: func(path string, reader io.Reader) (int64, error) {
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return 0, err
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			files[path] = data
+			return int64(len(data)), nil
+		},
+		openReaderFunc: func(path string) (io.ReadCloser, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return ioutil.NopCloser(bytes.NewReader(files[path])), nil
+		},
 	}
 }
+
 func (t *testCacheIO) Write(path string, data []byte) error {
 	return t.writeFunc(path, data)
 }
@@ -40,6 +81,14 @@ func (t testCacheIO) Delete(path string) error {
 	return t.deleteFunc(path)
 }
 
+func (t testCacheIO) WriteFrom(path string, reader io.Reader) (int64, error) {
+	return t.writeFromFunc(path, reader)
+}
+
+func (t testCacheIO) OpenReader(path string) (io.ReadCloser, error) {
+	return t.openReaderFunc(path)
+}
+
 var aTime time.Time
 
 func init() {
@@ -273,25 +322,248 @@ func TestCache_Write(t *testing.T) {
 
 			if c.expectedRecentEntryHeap != nil {
 				for _, key := range c.expectedRecentEntryHeap {
-					popped := heap.Pop(cache.recentEntryHeap).(*CacheItem)
+					popped := heap.Pop(recentAge(cache).recentEntryHeap).(*CacheItem)
 					require.Equal(t, key, popped.key)
 				}
 			} else {
-				require.Equal(t, cache.recentEntryHeap.Len(), 0)
+				require.Equal(t, recentAge(cache).recentEntryHeap.Len(), 0)
 			}
 
 			if c.expectedAgedRecentHeap != nil {
 				for _, key := range c.expectedAgedRecentHeap {
-					popped := heap.Pop(cache.ageHeap).(*CacheItem)
+					popped := heap.Pop(recentAge(cache).ageHeap).(*CacheItem)
 					require.Equal(t, key, popped.key)
 				}
 			} else {
-				require.Equal(t, cache.ageHeap.Len(), 0)
+				require.Equal(t, recentAge(cache).ageHeap.Len(), 0)
 			}
 		})
 	}
 }
 
+func TestCache_Delete(t *testing.T) {
+	SystemBlockSize = 0
+
+	var deleted []string
+	cacheIO := newTestCacheIO()
+	cacheIO.deleteFunc = func(path string) error {
+		deleted = append(deleted, path)
+		return nil
+	}
+
+	cache := NewCache("/tmp", 6, 6, cacheIO)
+	for i, testItem := range []*testItem{
+		newTestItem("key.0", 2, 3),
+		newTestItem("key.1", 1, 3),
+		newTestItem("key.2", 0, 3),
+	} {
+		_, err := cache.Write(testItem.key, testItem.itemDate, ttime(i), testItem.data)
+		require.NoError(t, err)
+	}
+	require.True(t, recentAge(cache).ageHeap.Contains("key.0"))
+
+	removed, err := cache.Delete("key.0")
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Equal(t, []string{toFilePath("/tmp", "key.0", ttime(2))}, deleted)
+	require.Equal(t, 0, recentAge(cache).ageHeap.Len())
+	require.Equal(t, 0, recentAge(cache).ageHeap.sizeInBytes)
+
+	removed, err = cache.Delete("key.0")
+	require.NoError(t, err)
+	require.False(t, removed)
+	require.Len(t, deleted, 1)
+
+	count, err := cache.InvalidateKeys("key.1", "unknown", "key.2")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.Len(t, cache.index, 0)
+	require.Equal(t, 0, recentAge(cache).recentEntryHeap.Len())
+	require.Equal(t, 0, recentAge(cache).recentEntryHeap.sizeInBytes)
+
+	_, found, err := cache.Read("key.1")
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestCache_InvalidateKeys_DeleteError(t *testing.T) {
+	SystemBlockSize = 0
+
+	cacheIO := newTestCacheIO()
+	cacheIO.deleteFunc = func(path string) error {
+		return errors.New("disk gone")
+	}
+
+	cache := NewCache("/tmp", 100, 100, cacheIO)
+	_, err := cache.Write("key.0", ttime(0), ttime(0), []byte{1})
+	require.NoError(t, err)
+	_, err = cache.Write("key.1", ttime(1), ttime(1), []byte{1})
+	require.NoError(t, err)
+
+	count, err := cache.InvalidateKeys("key.0", "key.1")
+	require.Error(t, err)
+	require.Equal(t, 2, count)
+	require.Len(t, cache.index, 0)
+}
+
+func TestCache_Streaming(t *testing.T) {
+	SystemBlockSize = 0
+
+	cache := NewCache(t.TempDir(), 10, 10, NewFileIO())
+
+	payload := bytes.Repeat([]byte{0xab}, 7)
+	item, err := cache.WriteFrom("key.0", ttime(0), ttime(0), bytes.NewReader(payload))
+	require.NoError(t, err)
+	require.Equal(t, 7, item.size)
+	require.Equal(t, 7, recentAge(cache).recentEntryHeap.sizeInBytes)
+
+	reader, found, err := cache.OpenReader("key.0")
+	require.NoError(t, err)
+	require.True(t, found)
+	content, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, payload, content)
+
+	again, err := cache.WriteFrom("key.0", ttime(0), ttime(1), iotest.ErrReader(errors.New("must not be read")))
+	require.NoError(t, err)
+	require.Equal(t, item, again)
+
+	_, err = cache.WriteFrom("key.1", ttime(1), ttime(2), bytes.NewReader(payload))
+	require.NoError(t, err)
+	require.True(t, recentAge(cache).ageHeap.Contains("key.0"))
+	require.True(t, recentAge(cache).recentEntryHeap.Contains("key.1"))
+
+	_, found, err = cache.OpenReader("unknown")
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestCache_ReadCorrupted(t *testing.T) {
+	SystemBlockSize = 0
+
+	cacheIO := newTestCacheIO()
+	cache := NewCache("/tmp", 100, 100, cacheIO)
+	events := recordEvents(cache)
+
+	_, err := cache.Write("key.0", ttime(0), ttime(0), []byte("payload"))
+	require.NoError(t, err)
+	_, err = cache.Write("key.1", ttime(1), ttime(1), []byte("payload"))
+	require.NoError(t, err)
+
+	data, found, err := cache.Read("key.0")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("payload"), data)
+
+	// Flip a byte behind the cache back
+	require.NoError(t, cacheIO.Write(toFilePath("/tmp", "key.0", ttime(0)), []byte("pAyload")))
+	require.NoError(t, cacheIO.Write(toFilePath("/tmp", "key.1", ttime(1)), []byte("payl")))
+
+	_, found, err = cache.Read("key.0")
+	require.True(t, errors.Is(err, ErrCorrupted))
+	require.False(t, found)
+	require.NotContains(t, cache.index, "key.0")
+	require.Equal(t, 7, recentAge(cache).recentEntryHeap.sizeInBytes)
+	require.Equal(t, []string{"key.0:corrupted"}, events.get("evict"))
+
+	reader, found, err := cache.OpenReader("key.1")
+	require.NoError(t, err)
+	require.True(t, found)
+	_, err = ioutil.ReadAll(reader)
+	require.True(t, errors.Is(err, ErrCorrupted))
+	require.NoError(t, reader.Close())
+	require.NotContains(t, cache.index, "key.1")
+
+	require.Equal(t, uint64(2), cache.Stats().Corruptions)
+}
+
+func TestCache_Close(t *testing.T) {
+	SystemBlockSize = 0
+
+	release := make(chan struct{})
+	cacheIO := newTestCacheIO()
+	cacheIO.deleteFunc = func(path string) error {
+		<-release
+		return nil
+	}
+
+	cache := NewCache("/tmp", 3, 0, cacheIO)
+	_, err := cache.Write("key.0", ttime(0), ttime(0), []byte{1, 2, 3})
+	require.NoError(t, err)
+	_, err = cache.Write("key.1", ttime(1), ttime(1), []byte{1, 2, 3}) // evicts key.0, its deletion blocks
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.True(t, errors.Is(cache.Close(ctx), context.DeadlineExceeded))
+
+	_, err = cache.Write("key.2", ttime(2), ttime(2), []byte{1})
+	require.Equal(t, ErrClosed, err)
+	_, _, err = cache.Read("key.1")
+	require.Equal(t, ErrClosed, err)
+	_, err = cache.Delete("key.1")
+	require.Equal(t, ErrClosed, err)
+
+	close(release)
+	require.NoError(t, cache.Close(context.Background()))
+}
+
+func TestCache_InitializeFailureStartsNothing(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	_, err := NewInitializedCache(path.Join(t.TempDir(), "missing"), 100, 100, NewFileIO(), WithExpirationInterval(time.Millisecond))
+	require.Error(t, err)
+	require.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+}
+
+func TestCache_Stats(t *testing.T) {
+	SystemBlockSize = 0
+
+	cacheIO := newTestCacheIO()
+	cacheIO.deleteFunc = func(path string) error {
+		return errors.New("disk gone")
+	}
+	cache := NewCache("/tmp", 6, 3, cacheIO)
+
+	for i, testItem := range []*testItem{
+		newTestItem("key.0", 2, 3),
+		newTestItem("key.1", 1, 3),
+		newTestItem("key.2", 0, 3),
+		newTestItem("key.3", 3, 3),
+	} {
+		_, err := cache.Write(testItem.key, testItem.itemDate, ttime(i), testItem.data)
+		require.NoError(t, err)
+	}
+
+	_, _, err := cache.Read("key.3")
+	require.NoError(t, err)
+	_, _, err = cache.Read("key.2")
+	require.NoError(t, err)
+	_, _, err = cache.Read("unknown")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return cache.Stats().DeleteFailures == 1
+	}, time.Second, 5*time.Millisecond)
+
+	stats := cache.Stats()
+	require.Equal(t, uint64(2), stats.Hits)
+	require.Equal(t, uint64(1), stats.Misses)
+	require.InDelta(t, 2.0/3.0, stats.HitRatio(), 0.0001)
+	require.Equal(t, 3, stats.ItemCount)
+	require.Equal(t, 2, stats.RecentEntryCount)
+	require.Equal(t, 6, stats.RecentEntryBytes)
+	require.Equal(t, 1, stats.AgeCount)
+	require.Equal(t, 3, stats.AgeBytes)
+	require.Equal(t, uint64(2), stats.RecentEntryEvictions)
+	require.Equal(t, uint64(0), stats.AgeEvictions)
+	require.Equal(t, uint64(4), stats.WriteLatency.Count)
+	require.Equal(t, uint64(2), stats.ReadLatency.Count)
+	require.Equal(t, uint64(1), stats.DeleteLatency.Count)
+	require.Len(t, stats.ReadLatency.Buckets, len(LatencyBuckets))
+}
+
 //func TestCache_Purge(t *testing.T) {
 //	aTime, err := time.Parse(DateFormat, DateFormat)
 //	require.NoError(t, err)
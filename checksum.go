@@ -0,0 +1,87 @@
+package atm
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// ErrCorrupted is returned when the data read back for a key does not match
+// the checksum computed when it was written. The entry is evicted, callers
+// should refetch the data from its source of truth.
+var ErrCorrupted = errors.New("cache item corrupted")
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func newChecksumHash() hash.Hash32 {
+	return crc32.New(castagnoliTable)
+}
+
+func checksumOf(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoliTable)
+}
+
+func (i *CacheItem) setChecksum(checksum uint32) {
+	i.checksum = checksum
+	i.checksummed = true
+}
+
+// verify reports whether checksum matches the item checksum, items indexed from
+// a bare file, without checksum, are always considered valid.
+func (i *CacheItem) verify(checksum uint32) bool {
+	return !i.checksummed || i.checksum == checksum
+}
+
+func corruptedError(cacheItem *CacheItem) error {
+	return fmt.Errorf("%w: checksum mismatch for key %q", ErrCorrupted, cacheItem.key)
+}
+
+// evictCorrupted removes cacheItem from the cache, unless it was already
+// replaced, and deletes its backing file. The file is deleted right away, the
+// refetched data is written to the same path.
+func (c *Cache) evictCorrupted(cacheItem *CacheItem) {
+	defer c.dispatchEvents()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zlog.Warn("evicting corrupted cache item", zap.Stringer("item", cacheItem))
+	atomic.AddUint64(&c.stats.corruptions, 1)
+
+	if c.closed || c.index[cacheItem.key] != cacheItem {
+		return
+	}
+
+	c.removeWithLock(cacheItem.key)
+	c.emitWithLock(eventEvict, cacheItem, ReasonCorrupted)
+	if err := c.deleteFileWithLock(cacheItem, ReasonCorrupted); err != nil {
+		zlog.Warn("failed to delete corrupted file", zap.String("file", cacheItem.filePath), zap.Error(err))
+	}
+}
+
+// verifyingReader checks the checksum of the streamed data once the
+// underlying reader is exhausted, turning io.EOF into ErrCorrupted on mismatch.
+type verifyingReader struct {
+	io.ReadCloser
+
+	cache     *Cache
+	cacheItem *CacheItem
+	hash      hash.Hash32
+}
+
+func (r *verifyingReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+
+	if err == io.EOF && !r.cacheItem.verify(r.hash.Sum32()) {
+		r.cache.evictCorrupted(r.cacheItem)
+		return n, corruptedError(r.cacheItem)
+	}
+
+	return n, err
+}
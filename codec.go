@@ -0,0 +1,257 @@
+package atm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec transforms item data between what is handed to the cache and what is
+// stored through the CacheIO. The codec name is recorded with every item, in
+// its file name and in the manifest, so items written with a codec remain
+// readable after the cache is configured with another one.
+type Codec interface {
+	// Name identifies the codec, it must be a non-empty string made of
+	// [a-z0-9] characters.
+	Name() string
+	NewWriter(writer io.Writer) (io.WriteCloser, error)
+	NewReader(reader io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	// NoCompression stores data as is, it is the default codec.
+	NoCompression Codec = noneCodec{}
+	// ZstdCompression stores data as zstd frames.
+	ZstdCompression Codec = zstdCodec{}
+	// SnappyCompression stores data using the snappy framing format.
+	SnappyCompression Codec = snappyCodec{}
+)
+
+var codecsLock sync.RWMutex
+var codecs = map[string]Codec{}
+
+func init() {
+	RegisterCodec(NoCompression)
+	RegisterCodec(ZstdCompression)
+	RegisterCodec(SnappyCompression)
+}
+
+// RegisterCodec makes codec available to decode items recorded with its name.
+func RegisterCodec(codec Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+func codecByName(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	codec, found := codecs[name]
+	if !found {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+
+	return codec, nil
+}
+
+// sliceCodec is implemented by codecs encoding whole slices more cheaply than
+// through a stream.
+type sliceCodec interface {
+	encodeAll(data []byte) ([]byte, error)
+	decodeAll(data []byte) ([]byte, error)
+}
+
+// encode returns data encoded with codec, the returned slice is data itself
+// for NoCompression.
+func encode(codec Codec, data []byte) ([]byte, error) {
+	if codec == NoCompression {
+		return data, nil
+	}
+	if codec, ok := codec.(sliceCodec); ok {
+		return codec.encodeAll(data)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	writer, err := codec.NewWriter(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decode(codec Codec, data []byte) ([]byte, error) {
+	if codec == NoCompression {
+		return data, nil
+	}
+	if codec, ok := codec.(sliceCodec); ok {
+		return codec.decodeAll(data)
+	}
+
+	reader, err := codec.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// encodingReader returns a reader streaming the content of reader encoded with
+// codec. Closing it releases the encoding goroutine when the stream is not
+// consumed up to the end.
+func encodingReader(codec Codec, reader io.Reader) io.ReadCloser {
+	if codec == NoCompression {
+		return ioutil.NopCloser(reader)
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		writer, err := codec.NewWriter(pipeWriter)
+		if err == nil {
+			_, err = io.Copy(writer, reader)
+			if closeErr := writer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return pipeReader
+}
+
+// decodingReader wraps reader with the decoding stream of codec, closing it
+// closes both.
+func decodingReader(codec Codec, reader io.ReadCloser) (io.ReadCloser, error) {
+	if codec == NoCompression {
+		return reader, nil
+	}
+
+	decoded, err := codec.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stackedReadCloser{Reader: decoded, closers: []io.Closer{decoded, reader}}, nil
+}
+
+type stackedReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *stackedReadCloser) Close() (err error) {
+	for _, closer := range r.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{writer}, nil
+}
+
+func (noneCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(reader), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (zstdCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(writer)
+}
+
+func (zstdCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.IOReadCloser(), nil
+}
+
+// zstdShared holds the encoder and decoder of whole slices, both are safe for
+// concurrent use and costly to create, so a single pair serves every item.
+var zstdShared struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func sharedZstd() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdShared.once.Do(func() {
+		zstdShared.encoder, zstdShared.err = zstd.NewWriter(nil)
+		if zstdShared.err == nil {
+			zstdShared.decoder, zstdShared.err = zstd.NewReader(nil)
+		}
+	})
+
+	return zstdShared.encoder, zstdShared.decoder, zstdShared.err
+}
+
+func (zstdCodec) encodeAll(data []byte) ([]byte, error) {
+	encoder, _, err := sharedZstd()
+	if err != nil {
+		return nil, err
+	}
+
+	return encoder.EncodeAll(data, nil), nil
+}
+
+func (zstdCodec) decodeAll(data []byte) ([]byte, error) {
+	_, decoder, err := sharedZstd()
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.DecodeAll(data, nil)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) NewWriter(writer io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(writer), nil
+}
+
+func (snappyCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(snappy.NewReader(reader)), nil
+}
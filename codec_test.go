@@ -0,0 +1,118 @@
+package atm
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodec_RoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("block payload "), 100)
+
+	for _, codec := range []Codec{NoCompression, ZstdCompression, SnappyCompression} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			encoded, err := encode(codec, payload)
+			require.NoError(t, err)
+			if codec != NoCompression {
+				require.Less(t, len(encoded), len(payload))
+			}
+
+			decoded, err := decode(codec, encoded)
+			require.NoError(t, err)
+			require.Equal(t, payload, decoded)
+
+			streamed, err := ioutil.ReadAll(encodingReader(codec, bytes.NewReader(payload)))
+			require.NoError(t, err)
+
+			// Items written whole or streamed are read back either way
+			decoded, err = decode(codec, streamed)
+			require.NoError(t, err)
+			require.Equal(t, payload, decoded)
+			reader, err := decodingReader(codec, ioutil.NopCloser(bytes.NewReader(encoded)))
+			require.NoError(t, err)
+			decoded, err = ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+			require.Equal(t, payload, decoded)
+
+			reader, err = decodingReader(codec, ioutil.NopCloser(bytes.NewReader(streamed)))
+			require.NoError(t, err)
+			decoded, err = ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+			require.Equal(t, payload, decoded)
+		})
+	}
+}
+
+func TestCache_Codec(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+	payload := bytes.Repeat([]byte("block payload "), 100)
+
+	cache, err := NewInitializedCache(basePath, 10_000, 10_000, NewFileIO(), WithCodec(ZstdCompression))
+	require.NoError(t, err)
+
+	item, err := cache.Write("key.0", ttime(0), ttime(0), payload)
+	require.NoError(t, err)
+	require.Less(t, item.size, len(payload))
+	require.Equal(t, item.size, recentAge(cache).recentEntryHeap.sizeInBytes)
+
+	streamed, err := cache.WriteFrom("key.1", ttime(1), ttime(1), bytes.NewReader(payload))
+	require.NoError(t, err)
+	require.Less(t, streamed.size, len(payload))
+
+	data, found, err := cache.Read("key.0")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, payload, data)
+
+	reader, found, err := cache.OpenReader("key.1")
+	require.NoError(t, err)
+	require.True(t, found)
+	data, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, payload, data)
+	require.NoError(t, cache.Close(context.Background()))
+
+	// Reopened with another codec, and without the manifest for part of the items
+	reopened, err := NewInitializedCache(basePath, 10_000, 10_000, NewFileIO(), WithCodec(SnappyCompression))
+	require.NoError(t, err)
+	defer reopened.Close(context.Background())
+
+	_, err = reopened.Write("key.2", ttime(2), ttime(2), payload)
+	require.NoError(t, err)
+	require.Equal(t, SnappyCompression, reopened.index["key.2"].codec)
+	require.Equal(t, ZstdCompression, reopened.index["key.0"].codec)
+
+	for _, key := range []string{"key.0", "key.1", "key.2"} {
+		data, found, err := reopened.Read(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, payload, data)
+	}
+}
+
+func TestCache_CodecFromFileName(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+	payload := bytes.Repeat([]byte("block payload "), 100)
+
+	cache := NewCache(basePath, 10_000, 10_000, NewFileIO(), WithCodec(SnappyCompression))
+	_, err := cache.Write("key.0", ttime(0), ttime(0), payload)
+	require.NoError(t, err)
+	require.NoError(t, cache.Close(context.Background()))
+
+	reopened, err := NewInitializedCache(basePath, 10_000, 10_000, NewFileIO(), WithManifestCheckpointInterval(0))
+	require.NoError(t, err)
+	defer reopened.Close(context.Background())
+
+	data, found, err := reopened.Read("key.0")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, payload, data)
+}
@@ -0,0 +1,389 @@
+package atm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// KeyProvider supplies the keys used by EncryptedIO. Keys must be 16, 24 or 32
+// bytes long to select AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the key new files are encrypted with, along with its
+	// identifier which is stored in every file.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key identified by id, used to decrypt existing files.
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding keys in memory. Rotating the key ring
+// changes the key new files are encrypted with while previous keys remain
+// available to read older files until they are removed.
+type KeyRing struct {
+	mu        sync.RWMutex
+	currentID string
+	keys      map[string][]byte
+}
+
+func NewKeyRing(id string, key []byte) (*KeyRing, error) {
+	r := &KeyRing{keys: map[string][]byte{}}
+	if err := r.Rotate(id, key); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Rotate adds key under id and makes it the current key.
+func (r *KeyRing) Rotate(id string, key []byte) error {
+	if err := validateKeyID(id); err != nil {
+		return err
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("invalid key %q: %w", id, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys[id] = key
+	r.currentID = id
+	return nil
+}
+
+// Remove forgets the key identified by id, files encrypted with it become
+// unreadable. The current key cannot be removed.
+func (r *KeyRing) Remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id == r.currentID {
+		return fmt.Errorf("cannot remove current key %q", id)
+	}
+
+	delete(r.keys, id)
+	return nil
+}
+
+// validateKeyID checks that id fits in the single length byte of the file
+// header.
+func validateKeyID(id string) error {
+	if len(id) == 0 || len(id) > 255 {
+		return fmt.Errorf("invalid key id %q, must be between 1 and 255 bytes", id)
+	}
+	return nil
+}
+
+func (r *KeyRing) CurrentKey() (string, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.currentID, r.keys[r.currentID], nil
+}
+
+func (r *KeyRing) Key(id string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, found := r.keys[id]
+	if !found {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+
+	return key, nil
+}
+
+// ErrUnknownKey is returned when a file was encrypted with a key the
+// KeyProvider does not know about.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// EncryptedIO is a CacheIO encrypting data with AES-GCM before handing it to
+// the wrapped CacheIO.
+//
+// Files start with a header holding the identifier of the key they are
+// encrypted with and a random nonce, followed by the data sealed in chunks of
+// encryptionChunkSize bytes so files can be streamed. Every chunk is
+// authenticated along with the header and a flag marking the last chunk,
+// which is always shorter than a full chunk, so reordered, altered or
+// truncated files are detected.
+type EncryptedIO struct {
+	cacheIO CacheIO
+	keys    KeyProvider
+}
+
+func NewEncryptedIO(cacheIO CacheIO, keys KeyProvider) *EncryptedIO {
+	return &EncryptedIO{cacheIO: cacheIO, keys: keys}
+}
+
+var encryptionMagic = []byte("ATME")
+
+const encryptionVersion = 1
+const encryptionChunkSize = 64 * 1024
+
+func (e *EncryptedIO) Write(path string, data []byte) error {
+	_, err := e.WriteFrom(path, bytes.NewReader(data))
+	return err
+}
+
+// WriteFrom encrypts reader into path, it returns the number of encrypted
+// bytes written by the wrapped CacheIO.
+func (e *EncryptedIO) WriteFrom(path string, reader io.Reader) (int64, error) {
+	encrypter, err := e.newEncryptingReader(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	return e.cacheIO.WriteFrom(path, encrypter)
+}
+
+func (e *EncryptedIO) Read(path string) ([]byte, error) {
+	reader, err := e.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (e *EncryptedIO) OpenReader(path string) (io.ReadCloser, error) {
+	reader, err := e.cacheIO.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{source: reader, keys: e.keys}, nil
+}
+
+func (e *EncryptedIO) Delete(path string) error {
+	return e.cacheIO.Delete(path)
+}
+
+func encryptionHeader(keyID string, nonce []byte) []byte {
+	header := make([]byte, 0, len(encryptionMagic)+2+len(keyID)+len(nonce))
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionVersion, byte(len(keyID)))
+	header = append(header, keyID...)
+	return append(header, nonce...)
+}
+
+// chunkNonce derives the nonce of a chunk by mixing its index into the file
+// nonce, every chunk of a file is thus sealed with a distinct nonce.
+func chunkNonce(dst, fileNonce []byte, index uint64) []byte {
+	dst = append(dst[:0], fileNonce...)
+	offset := len(dst) - 8
+	binary.BigEndian.PutUint64(dst[offset:], binary.BigEndian.Uint64(dst[offset:])^index)
+	return dst
+}
+
+func chunkAdditionalData(dst, header []byte, last bool) []byte {
+	dst = append(dst[:0], header...)
+	if last {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type encryptingReader struct {
+	source io.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+
+	chunk        []byte
+	pending      []byte
+	chunkIndex   uint64
+	nonceScratch []byte
+	adScratch    []byte
+	done         bool
+}
+
+func (e *EncryptedIO) newEncryptingReader(source io.Reader) (*encryptingReader, error) {
+	keyID, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("getting current encryption key: %w", err)
+	}
+	if err := validateKeyID(keyID); err != nil {
+		return nil, fmt.Errorf("current encryption key: %w", err)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %q: %w", keyID, err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	header := encryptionHeader(keyID, nonce)
+	return &encryptingReader{
+		source:  source,
+		aead:    aead,
+		header:  header,
+		nonce:   nonce,
+		chunk:   make([]byte, encryptionChunkSize),
+		pending: append([]byte(nil), header...),
+	}, nil
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.sealNextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *encryptingReader) sealNextChunk() error {
+	n, err := io.ReadFull(r.source, r.chunk)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	}
+
+	r.nonceScratch = chunkNonce(r.nonceScratch, r.nonce, r.chunkIndex)
+	r.adScratch = chunkAdditionalData(r.adScratch, r.header, last)
+	r.pending = r.aead.Seal(r.pending[:0], r.nonceScratch, r.chunk[:n], r.adScratch)
+	r.chunkIndex++
+	r.done = last
+
+	return nil
+}
+
+type decryptingReader struct {
+	source io.ReadCloser
+	keys   KeyProvider
+
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+
+	chunk        []byte
+	plain        []byte
+	pending      []byte
+	chunkIndex   uint64
+	nonceScratch []byte
+	adScratch    []byte
+	done         bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.aead == nil {
+		if err := r.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.openNextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) readHeader() error {
+	prefix := make([]byte, len(encryptionMagic)+2)
+	if _, err := io.ReadFull(r.source, prefix); err != nil {
+		return fmt.Errorf("reading encryption header: %w", err)
+	}
+	if !bytes.Equal(prefix[:len(encryptionMagic)], encryptionMagic) {
+		return errors.New("invalid encryption header magic")
+	}
+	if version := prefix[len(encryptionMagic)]; version != encryptionVersion {
+		return fmt.Errorf("unsupported encryption version %d", version)
+	}
+
+	keyID := make([]byte, prefix[len(encryptionMagic)+1])
+	if _, err := io.ReadFull(r.source, keyID); err != nil {
+		return fmt.Errorf("reading encryption key id: %w", err)
+	}
+
+	key, err := r.keys.Key(string(keyID))
+	if err != nil {
+		return err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return fmt.Errorf("encryption key %q: %w", keyID, err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r.source, nonce); err != nil {
+		return fmt.Errorf("reading encryption nonce: %w", err)
+	}
+
+	r.aead = aead
+	r.nonce = nonce
+	r.header = encryptionHeader(string(keyID), nonce)
+	r.chunk = make([]byte, encryptionChunkSize+aead.Overhead())
+	return nil
+}
+
+func (r *decryptingReader) openNextChunk() error {
+	n, err := io.ReadFull(r.source, r.chunk)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	}
+
+	if n < r.aead.Overhead() {
+		return errors.New("truncated encrypted file")
+	}
+
+	r.nonceScratch = chunkNonce(r.nonceScratch, r.nonce, r.chunkIndex)
+	r.adScratch = chunkAdditionalData(r.adScratch, r.header, last)
+	r.plain, err = r.aead.Open(r.plain[:0], r.nonceScratch, r.chunk[:n], r.adScratch)
+	if err != nil {
+		return fmt.Errorf("decrypting chunk %d: %w", r.chunkIndex, err)
+	}
+
+	r.pending = r.plain
+	r.chunkIndex++
+	r.done = last
+	return nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.source.Close()
+}
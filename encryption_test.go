@@ -0,0 +1,146 @@
+package atm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedIO_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	encryptedIO := NewEncryptedIO(NewFileIO(), keys)
+
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+		payload := bytes.Repeat([]byte("b"), size)
+		filePath := path.Join(dir, "item")
+
+		require.NoError(t, encryptedIO.Write(filePath, payload))
+		data, err := encryptedIO.Read(filePath)
+		require.NoError(t, err)
+		require.Equal(t, payload, data, "size %d", size)
+
+		written, err := encryptedIO.WriteFrom(filePath, bytes.NewReader(payload))
+		require.NoError(t, err)
+		require.Greater(t, written, int64(size))
+
+		raw, err := ioutil.ReadFile(filePath)
+		require.NoError(t, err)
+		require.Equal(t, written, int64(len(raw)))
+		if size >= 16 {
+			require.False(t, bytes.Contains(raw, payload[:16]), "size %d", size)
+		}
+
+		reader, err := encryptedIO.OpenReader(filePath)
+		require.NoError(t, err)
+		data, err = ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, payload, data, "size %d", size)
+	}
+}
+
+// fixedKey is a KeyProvider handing out a single key under any id.
+type fixedKey struct {
+	id  string
+	key []byte
+}
+
+func (k fixedKey) CurrentKey() (string, []byte, error) { return k.id, k.key, nil }
+func (k fixedKey) Key(id string) ([]byte, error)       { return k.key, nil }
+
+func TestEncryptedIO_InvalidKeyID(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "item")
+	key := bytes.Repeat([]byte{1}, 32)
+
+	for _, id := range []string{"", string(bytes.Repeat([]byte("k"), 256))} {
+		encryptedIO := NewEncryptedIO(NewFileIO(), fixedKey{id: id, key: key})
+		require.Error(t, encryptedIO.Write(filePath, []byte("data")), "id of %d bytes", len(id))
+	}
+
+	encryptedIO := NewEncryptedIO(NewFileIO(), fixedKey{id: string(bytes.Repeat([]byte("k"), 255)), key: key})
+	require.NoError(t, encryptedIO.Write(filePath, []byte("data")))
+	data, err := encryptedIO.Read(filePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+}
+
+func TestEncryptedIO_Tampering(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 16))
+	require.NoError(t, err)
+	encryptedIO := NewEncryptedIO(NewFileIO(), keys)
+	filePath := path.Join(dir, "item")
+
+	require.NoError(t, encryptedIO.Write(filePath, bytes.Repeat([]byte("b"), 2*encryptionChunkSize)))
+	raw, err := ioutil.ReadFile(filePath)
+	require.NoError(t, err)
+
+	flipped := append([]byte(nil), raw...)
+	flipped[len(flipped)/2] ^= 0x01
+	require.NoError(t, ioutil.WriteFile(filePath, flipped, 0644))
+	_, err = encryptedIO.Read(filePath)
+	require.Error(t, err)
+
+	// Truncated on a chunk boundary, the last remaining chunk is not marked as final
+	headerSize := len(raw) - 2*(encryptionChunkSize+16) - 16
+	require.NoError(t, ioutil.WriteFile(filePath, raw[:headerSize+encryptionChunkSize+16], 0644))
+	_, err = encryptedIO.Read(filePath)
+	require.Error(t, err)
+}
+
+func TestEncryptedIO_KeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	encryptedIO := NewEncryptedIO(NewFileIO(), keys)
+
+	oldPath, newPath := path.Join(dir, "old"), path.Join(dir, "new")
+	require.NoError(t, encryptedIO.Write(oldPath, []byte("old")))
+
+	require.Error(t, keys.Rotate("k2", []byte("short")))
+	require.NoError(t, keys.Rotate("k2", bytes.Repeat([]byte{2}, 32)))
+	require.NoError(t, encryptedIO.Write(newPath, []byte("new")))
+
+	data, err := encryptedIO.Read(oldPath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), data)
+	data, err = encryptedIO.Read(newPath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), data)
+
+	require.Error(t, keys.Remove("k2"))
+	require.NoError(t, keys.Remove("k1"))
+	_, err = encryptedIO.Read(oldPath)
+	require.True(t, errors.Is(err, ErrUnknownKey))
+}
+
+func TestCache_EncryptedIO(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	payload := bytes.Repeat([]byte("block payload "), 100)
+
+	cache, err := NewInitializedCache(basePath, 10_000, 10_000, NewEncryptedIO(NewFileIO(), keys), WithCodec(ZstdCompression))
+	require.NoError(t, err)
+	defer cache.Close(context.Background())
+
+	_, err = cache.Write("key.0", ttime(0), ttime(0), payload)
+	require.NoError(t, err)
+	_, err = cache.WriteFrom("key.1", ttime(1), ttime(1), bytes.NewReader(payload))
+	require.NoError(t, err)
+
+	for _, key := range []string{"key.0", "key.1"} {
+		data, found, err := cache.Read(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, payload, data)
+	}
+}
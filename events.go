@@ -0,0 +1,189 @@
+package atm
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EventReason describes why a lifecycle event happened to a cache item.
+type EventReason int
+
+const (
+	// ReasonWrite is used when an item is written to the cache.
+	ReasonWrite EventReason = iota
+	// ReasonCapacity is used when an item is moved or dropped to make room for
+	// newer items.
+	ReasonCapacity
+	// ReasonTooOld is used when an item leaving the recent entry heap is older
+	// than every item kept in the age heap.
+	ReasonTooOld
+	// ReasonExplicit is used when an item is removed through Delete or
+	// InvalidateKeys.
+	ReasonExplicit
+	// ReasonCorrupted is used when the data read back for an item does not
+	// match its checksum.
+	ReasonCorrupted
+	// ReasonExpired is used when an item written with a TTL expires.
+	ReasonExpired
+	// ReasonReorg is used when a block is invalidated because the chain
+	// reorganized.
+	ReasonReorg
+	// ReasonIrreversible is used when a reversible block leaves the reversible
+	// tier once marked irreversible.
+	ReasonIrreversible
+)
+
+func (r EventReason) String() string {
+	switch r {
+	case ReasonWrite:
+		return "write"
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonTooOld:
+		return "too_old"
+	case ReasonExplicit:
+		return "explicit"
+	case ReasonCorrupted:
+		return "corrupted"
+	case ReasonExpired:
+		return "expired"
+	case ReasonReorg:
+		return "reorg"
+	case ReasonIrreversible:
+		return "irreversible"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
+
+// EventListener receives cache item lifecycle events. Listeners are called
+// outside of the cache lock, possibly concurrently, and may call back into the
+// cache. The item must be treated as read-only.
+type EventListener func(item *CacheItem, reason EventReason)
+
+type eventKind int
+
+const (
+	eventInsert eventKind = iota
+	eventPromote
+	eventEvict
+	eventDelete
+	eventKindCount
+)
+
+type event struct {
+	kind   eventKind
+	item   *CacheItem
+	reason EventReason
+}
+
+// Unsubscribe removes the listener it was returned for, later calls do
+// nothing. Events already being delivered may still reach the listener.
+type Unsubscribe func()
+
+type subscription struct {
+	id       uint64
+	listener EventListener
+}
+
+// OnInsert registers a listener called when an item is added to the index.
+func (c *Cache) OnInsert(listener EventListener) Unsubscribe {
+	return c.subscribe(eventInsert, listener)
+}
+
+// OnPromote registers a listener called when an item moves from the recent
+// entry heap to the age heap, or out of the reversible tier.
+func (c *Cache) OnPromote(listener EventListener) Unsubscribe {
+	return c.subscribe(eventPromote, listener)
+}
+
+// OnEvict registers a listener called when an item is removed from the index.
+func (c *Cache) OnEvict(listener EventListener) Unsubscribe {
+	return c.subscribe(eventEvict, listener)
+}
+
+// OnDelete registers a listener called once the backing file of a removed
+// item has been deleted through the CacheIO.
+func (c *Cache) OnDelete(listener EventListener) Unsubscribe {
+	return c.subscribe(eventDelete, listener)
+}
+
+func (c *Cache) subscribe(kind eventKind, listener EventListener) Unsubscribe {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+
+	c.nextListenerID++
+	id := c.nextListenerID
+	c.listeners[kind] = append(c.listeners[kind], subscription{id: id, listener: listener})
+
+	return func() {
+		c.unsubscribe(kind, id)
+	}
+}
+
+func (c *Cache) unsubscribe(kind eventKind, id uint64) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+
+	// The slice is copied, notify may be iterating over the current one
+	subscriptions := make([]subscription, 0, len(c.listeners[kind]))
+	for _, s := range c.listeners[kind] {
+		if s.id != id {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	c.listeners[kind] = subscriptions
+}
+
+// emitWithLock queues an event, it is delivered by the next dispatchEvents call
+// once the cache lock is released.
+func (c *Cache) emitWithLock(kind eventKind, item *CacheItem, reason EventReason) { //this func should always be call within a cache lock
+	c.pendingEvents = append(c.pendingEvents, event{kind: kind, item: item, reason: reason})
+}
+
+// dispatchEvents delivers queued events, it must be called without holding the
+// cache lock.
+func (c *Cache) dispatchEvents() {
+	c.mu.Lock()
+	events := c.pendingEvents
+	c.pendingEvents = nil
+	c.mu.Unlock()
+
+	for _, e := range events {
+		c.notify(e.kind, e.item, e.reason)
+	}
+}
+
+func (c *Cache) notify(kind eventKind, item *CacheItem, reason EventReason) {
+	c.listenersMu.RLock()
+	listeners := c.listeners[kind]
+	c.listenersMu.RUnlock()
+
+	for _, s := range listeners {
+		s.listener(item, reason)
+	}
+}
+
+// deleteFileAsync deletes the backing file of an item removed from the index
+// in the background, notifying delete listeners once done. Close waits for
+// those deletions to complete.
+func (c *Cache) deleteFileAsync(item *CacheItem, reason EventReason) {
+	c.deletions.Add(1)
+	go func() {
+		defer c.deletions.Done()
+
+		start := time.Now()
+		err := c.cacheIO.Delete(item.filePath)
+		c.stats.observe(ioDelete, start)
+		if err != nil {
+			atomic.AddUint64(&c.stats.deleteFailures, 1)
+			zlog.Warn("failed to delete file", zap.String("file", item.filePath), zap.Stringer("reason", reason), zap.Error(err))
+			return
+		}
+
+		c.notify(eventDelete, item, reason)
+	}()
+}
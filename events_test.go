@@ -0,0 +1,109 @@
+package atm
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordedEvents struct {
+	mu     sync.Mutex
+	events map[string][]string
+}
+
+func recordEvents(cache *Cache) *recordedEvents {
+	r := &recordedEvents{events: map[string][]string{}}
+	record := func(kind string) EventListener {
+		return func(item *CacheItem, reason EventReason) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.events[kind] = append(r.events[kind], item.Key()+":"+reason.String())
+		}
+	}
+
+	cache.OnInsert(record("insert"))
+	cache.OnPromote(record("promote"))
+	cache.OnEvict(record("evict"))
+	cache.OnDelete(record("delete"))
+
+	return r
+}
+
+func (r *recordedEvents) get(kind string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := append([]string(nil), r.events[kind]...)
+	sort.Strings(out)
+	return out
+}
+
+func TestCache_Events(t *testing.T) {
+	SystemBlockSize = 0
+
+	cache := NewCache("/tmp", 6, 6, newTestCacheIO())
+	events := recordEvents(cache)
+
+	for i, testItem := range []*testItem{
+		newTestItem("key.0", 4, 3),
+		newTestItem("key.1", 3, 3),
+		newTestItem("key.2", 2, 3),
+		newTestItem("key.3", 1, 3),
+		newTestItem("key.4", 0, 3),
+	} {
+		_, err := cache.Write(testItem.key, testItem.itemDate, ttime(i), testItem.data)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []string{"key.0:write", "key.1:write", "key.2:write", "key.3:write", "key.4:write"}, events.get("insert"))
+	require.Equal(t, []string{"key.0:capacity", "key.1:capacity"}, events.get("promote"))
+	require.Equal(t, []string{"key.2:too_old"}, events.get("evict"))
+	require.Eventually(t, func() bool {
+		return len(events.get("delete")) == 1
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, []string{"key.2:too_old"}, events.get("delete"))
+
+	_, err := cache.Delete("key.3")
+	require.NoError(t, err)
+	require.Equal(t, []string{"key.2:too_old", "key.3:explicit"}, events.get("evict"))
+	require.Equal(t, []string{"key.2:too_old", "key.3:explicit"}, events.get("delete"))
+}
+
+func TestCache_EventsListenerReentrancy(t *testing.T) {
+	SystemBlockSize = 0
+
+	cache := NewCache("/tmp", 100, 100, newTestCacheIO())
+
+	var found bool
+	cache.OnInsert(func(item *CacheItem, reason EventReason) {
+		_, found, _ = cache.Read(item.Key())
+	})
+
+	_, err := cache.Write("key.0", ttime(0), ttime(0), []byte{1})
+	require.NoError(t, err)
+	require.True(t, found)
+}
+
+func TestCache_EventsUnsubscribe(t *testing.T) {
+	SystemBlockSize = 0
+
+	cache := NewCache("/tmp", 100, 100, newTestCacheIO())
+
+	var first, second int
+	unsubscribe := cache.OnInsert(func(item *CacheItem, reason EventReason) { first++ })
+	cache.OnInsert(func(item *CacheItem, reason EventReason) { second++ })
+
+	_, err := cache.Write("key.0", ttime(0), ttime(0), []byte{1})
+	require.NoError(t, err)
+
+	unsubscribe()
+	unsubscribe()
+	_, err = cache.Write("key.1", ttime(1), ttime(1), []byte{1})
+	require.NoError(t, err)
+
+	require.Equal(t, 1, first)
+	require.Equal(t, 2, second)
+}
@@ -0,0 +1,200 @@
+package atm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ErrInjectedFault is the error returned by FaultyIO when a rule without an
+// explicit error fires.
+var ErrInjectedFault = errors.New("injected fault")
+
+type FaultOp string
+
+const (
+	FaultAnyOp      FaultOp = ""
+	FaultWrite      FaultOp = "write"
+	FaultWriteFrom  FaultOp = "write_from"
+	FaultRead       FaultOp = "read"
+	FaultOpenReader FaultOp = "open_reader"
+	FaultDelete     FaultOp = "delete"
+)
+
+// FaultRule describes which calls of a FaultyIO fail. A call matching the
+// operation and path pattern of the rule fails when every trigger condition
+// holds, a rule without trigger conditions fails every matching call.
+type FaultRule struct {
+	// Op is the operation the rule applies to, every operation when FaultAnyOp.
+	Op FaultOp
+	// PathPattern is a path.Match pattern the base name of the path must match,
+	// every path when empty.
+	PathPattern string
+
+	// Nth fails only the nth matching call, counting from 1.
+	Nth int
+	// Probability fails matching calls at random, when between 0 and 1.
+	Probability float64
+	// Times limits how many calls the rule fails, unlimited when 0.
+	Times int
+
+	// AfterBytes makes write operations fail midway, the wrapped CacheIO
+	// receives that many bytes before the stream fails.
+	AfterBytes int
+	// Err is the error returned, ErrInjectedFault when nil.
+	Err error
+
+	matched int
+	fired   int
+}
+
+// FaultyIO is a CacheIO wrapper failing calls according to scriptable rules,
+// to test how the cache behaves when its storage misbehaves.
+type FaultyIO struct {
+	cacheIO CacheIO
+
+	mu     sync.Mutex
+	rules  []*FaultRule
+	random *rand.Rand
+}
+
+// NewFaultyIO wraps cacheIO, seed drives the random failures of the rules
+// using a Probability so test runs are reproducible.
+func NewFaultyIO(cacheIO CacheIO, seed int64) *FaultyIO {
+	return &FaultyIO{
+		cacheIO: cacheIO,
+		random:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// AddRule registers rule, the first rule firing for a call decides its error.
+func (f *FaultyIO) AddRule(rule FaultRule) error {
+	if rule.PathPattern != "" {
+		if _, err := path.Match(rule.PathPattern, ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %w", rule.PathPattern, err)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = append(f.rules, &rule)
+	return nil
+}
+
+// ClearRules removes every rule, calls are then all forwarded untouched.
+func (f *FaultyIO) ClearRules() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = nil
+}
+
+// fault returns the rule failing the call, if any.
+func (f *FaultyIO) fault(op FaultOp, filePath string) *FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, rule := range f.rules {
+		if rule.Op != FaultAnyOp && rule.Op != op {
+			continue
+		}
+		if rule.PathPattern != "" {
+			if matched, _ := path.Match(rule.PathPattern, path.Base(filePath)); !matched {
+				continue
+			}
+		}
+
+		rule.matched++
+		if rule.Times > 0 && rule.fired >= rule.Times {
+			continue
+		}
+		if rule.Nth > 0 && rule.matched != rule.Nth {
+			continue
+		}
+		if rule.Probability > 0 && f.random.Float64() >= rule.Probability {
+			continue
+		}
+
+		rule.fired++
+		zlog.Debug("injecting fault", zap.String("op", string(op)), zap.String("path", filePath))
+		return rule
+	}
+
+	return nil
+}
+
+func (r *FaultRule) error(op FaultOp, filePath string) error {
+	err := r.Err
+	if err == nil {
+		err = ErrInjectedFault
+	}
+
+	return fmt.Errorf("%s %s: %w", op, filePath, err)
+}
+
+func (f *FaultyIO) Write(path string, data []byte) error {
+	if rule := f.fault(FaultWrite, path); rule != nil {
+		if rule.AfterBytes > 0 {
+			_, err := f.cacheIO.WriteFrom(path, rule.failingReader(FaultWrite, path, bytes.NewReader(data)))
+			return err
+		}
+		return rule.error(FaultWrite, path)
+	}
+
+	return f.cacheIO.Write(path, data)
+}
+
+func (f *FaultyIO) WriteFrom(path string, reader io.Reader) (int64, error) {
+	if rule := f.fault(FaultWriteFrom, path); rule != nil {
+		if rule.AfterBytes > 0 {
+			return f.cacheIO.WriteFrom(path, rule.failingReader(FaultWriteFrom, path, reader))
+		}
+		return 0, rule.error(FaultWriteFrom, path)
+	}
+
+	return f.cacheIO.WriteFrom(path, reader)
+}
+
+// failingReader streams the first AfterBytes bytes of reader then fails.
+func (r *FaultRule) failingReader(op FaultOp, filePath string, reader io.Reader) io.Reader {
+	return io.MultiReader(io.LimitReader(reader, int64(r.AfterBytes)), &errorReader{err: r.error(op, filePath)})
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func (f *FaultyIO) Read(path string) ([]byte, error) {
+	if rule := f.fault(FaultRead, path); rule != nil {
+		return nil, rule.error(FaultRead, path)
+	}
+
+	return f.cacheIO.Read(path)
+}
+
+func (f *FaultyIO) OpenReader(path string) (io.ReadCloser, error) {
+	if rule := f.fault(FaultOpenReader, path); rule != nil {
+		return nil, rule.error(FaultOpenReader, path)
+	}
+
+	return f.cacheIO.OpenReader(path)
+}
+
+func (f *FaultyIO) Delete(path string) error {
+	if rule := f.fault(FaultDelete, path); rule != nil {
+		return rule.error(FaultDelete, path)
+	}
+
+	return f.cacheIO.Delete(path)
+}
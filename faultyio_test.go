@@ -0,0 +1,207 @@
+package atm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultyIO_Rules(t *testing.T) {
+	faultyIO := NewFaultyIO(NewMemoryIO(), 1)
+	require.NoError(t, faultyIO.Write("/cache/a", []byte("a")))
+
+	require.Error(t, faultyIO.AddRule(FaultRule{PathPattern: "["}))
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultRead, PathPattern: "a", Nth: 2}))
+
+	_, err := faultyIO.Read("/cache/a")
+	require.NoError(t, err)
+	_, err = faultyIO.Read("/cache/a")
+	require.True(t, errors.Is(err, ErrInjectedFault))
+	_, err = faultyIO.Read("/cache/a")
+	require.NoError(t, err)
+
+	faultyIO.ClearRules()
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultWrite, Times: 2, Err: syscall.ENOSPC}))
+	for i := 0; i < 2; i++ {
+		require.True(t, errors.Is(faultyIO.Write("/cache/b", []byte("b")), syscall.ENOSPC))
+	}
+	require.NoError(t, faultyIO.Write("/cache/b", []byte("b")))
+
+	faultyIO.ClearRules()
+	require.NoError(t, faultyIO.AddRule(FaultRule{Probability: 0.5}))
+	failures := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := faultyIO.Read("/cache/a"); err != nil {
+			failures++
+		}
+	}
+	require.InDelta(t, 500, failures, 100)
+}
+
+// requireConsistent checks that every indexed item is either pinned or lives in
+// exactly one heap of the default policy or the reversible tier, that the heaps
+// and pins bookkeeping matches their content and, when store is given, that
+// the data of every indexed item is stored.
+func requireConsistent(t *testing.T, cache *Cache, store *MemoryIO) {
+	t.Helper()
+
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	seen := map[string]bool{}
+	policy, isRecentAge := cache.policy.(*RecentAgePolicy)
+	if isRecentAge {
+		heaps := []*Heap{policy.recentEntryHeap, policy.ageHeap}
+		if cache.reversible != nil {
+			heaps = append(heaps, cache.reversible)
+		}
+
+		for _, h := range heaps {
+			size := 0
+			require.Len(t, h.positions, len(h.items))
+			for i, item := range h.items {
+				require.Equal(t, i, h.positions[item.key], "position of %q", item.key)
+				require.Same(t, cache.index[item.key], item, "indexed item %q", item.key)
+				require.Equal(t, h == cache.reversible, item.reversible, "reversible state of %q", item.key)
+				require.False(t, seen[item.key], "%q in both heaps", item.key)
+				seen[item.key] = true
+				size += item.size
+			}
+			require.Equal(t, size, h.sizeInBytes)
+			require.LessOrEqual(t, h.sizeInBytes, h.maxSizeInBytes)
+		}
+	}
+
+	pinnedCount, pinnedBytes := 0, 0
+	for key, item := range cache.index {
+		if item.pinned {
+			require.False(t, seen[key], "pinned %q in a heap", key)
+			pinnedCount++
+			pinnedBytes += item.size
+			seen[key] = true
+		}
+	}
+	require.Equal(t, pinnedCount, cache.pinnedCount)
+	require.Equal(t, pinnedBytes, cache.pinnedBytes)
+	if isRecentAge {
+		require.Len(t, cache.index, len(seen))
+	}
+
+	if store != nil {
+		for _, item := range cache.index {
+			_, err := store.load(item.filePath)
+			require.NoError(t, err, "data of %q", item.key)
+		}
+	}
+}
+
+func TestCache_WriteFaults(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	faultyIO := NewFaultyIO(store, 1)
+	cache := NewCache("/cache", 10, 10, faultyIO)
+	defer cache.Close(context.Background())
+
+	evictions := 0
+	cache.OnEvict(func(item *CacheItem, reason EventReason) { evictions++ })
+
+	for _, key := range []string{"a", "b"} {
+		_, err := cache.Write(key, ttime(0), ttime(0), []byte("12345"))
+		require.NoError(t, err)
+	}
+
+	// Failing outright, then midway, leaves the cache untouched
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultWrite, PathPattern: "c-*", Times: 1, Err: syscall.ENOSPC}))
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultWrite, PathPattern: "c-*", Times: 1, AfterBytes: 2}))
+	for i := 0; i < 2; i++ {
+		_, err := cache.Write("c", ttime(1), ttime(1), []byte("12345"))
+		require.Error(t, err)
+		requireConsistent(t, cache, store)
+		require.Equal(t, 2, recentAge(cache).recentEntryHeap.Len())
+		require.Equal(t, 0, recentAge(cache).ageHeap.Len())
+		require.Equal(t, 2, store.Len())
+		require.Equal(t, 0, evictions)
+	}
+
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultWriteFrom, PathPattern: "d-*", Times: 1, AfterBytes: 3}))
+	_, err := cache.WriteFrom("d", ttime(1), ttime(1), bytes.NewReader([]byte("12345")))
+	require.Error(t, err)
+	requireConsistent(t, cache, store)
+	require.NotContains(t, cache.index, "d")
+	require.Equal(t, 2, store.Len())
+
+	// Once the faults are exhausted, writes go through
+	_, err = cache.Write("c", ttime(1), ttime(1), []byte("12345"))
+	require.NoError(t, err)
+	_, err = cache.WriteFrom("d", ttime(1), ttime(1), bytes.NewReader([]byte("12345")))
+	require.NoError(t, err)
+	requireConsistent(t, cache, store)
+	require.Len(t, cache.index, 4)
+}
+
+func TestCache_ReadFaults(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	faultyIO := NewFaultyIO(store, 1)
+	cache := NewCache("/cache", 10, 10, faultyIO)
+	defer cache.Close(context.Background())
+
+	_, err := cache.Write("a", ttime(0), ttime(0), []byte("12345"))
+	require.NoError(t, err)
+
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultRead, Times: 1, Err: syscall.EIO}))
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultOpenReader, Times: 1, Err: syscall.EIO}))
+
+	_, _, err = cache.Read("a")
+	require.True(t, errors.Is(err, syscall.EIO))
+	_, _, err = cache.OpenReader("a")
+	require.True(t, errors.Is(err, syscall.EIO))
+	requireConsistent(t, cache, store)
+
+	// Transient read errors keep the entry
+	data, found, err := cache.Read("a")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("12345"), data)
+
+	reader, found, err := cache.OpenReader("a")
+	require.NoError(t, err)
+	require.True(t, found)
+	data, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, []byte("12345"), data)
+}
+
+func TestCache_DeleteFaults(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	faultyIO := NewFaultyIO(store, 1)
+	cache := NewCache("/cache", 10, 10, faultyIO)
+
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultDelete, Err: syscall.EIO}))
+
+	for i, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		_, err := cache.Write(key, ttime(i), ttime(i), []byte("12345"))
+		require.NoError(t, err)
+		requireConsistent(t, cache, store)
+	}
+
+	removed, err := cache.InvalidateKeys("f")
+	require.True(t, errors.Is(err, syscall.EIO))
+	require.Equal(t, 1, removed)
+	requireConsistent(t, cache, store)
+	require.NotContains(t, cache.index, "f")
+
+	require.NoError(t, cache.Close(context.Background()))
+	require.Equal(t, uint64(3), cache.Stats().DeleteFailures)
+	require.Len(t, cache.index, 3)
+
+	// Files that could not be deleted are left behind
+	require.Equal(t, 6, store.Len())
+}
@@ -0,0 +1,166 @@
+package atm
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FileNameVersion marks cache file names using the escaped key encoding
+// `<escaped key>-<item date>.v1`, optionally followed by `.<codec>` for
+// compressed items. Legacy file names, written as `<key>-<item date>`, always
+// end with the item date so both never collide.
+const FileNameVersion = ".v1"
+
+const upperHex = "0123456789ABCDEF"
+
+// escapeKey returns a file system safe version of key, every byte outside of
+// [A-Za-z0-9._] is written as %XX. The escaped key never contains `-`, which
+// is used as the separator with the item date.
+func escapeKey(key string) string {
+	var out strings.Builder
+	out.Grow(len(key))
+
+	for i := 0; i < len(key); i++ {
+		b := key[i]
+		if isSafeKeyByte(b) {
+			out.WriteByte(b)
+			continue
+		}
+
+		out.WriteByte('%')
+		out.WriteByte(upperHex[b>>4])
+		out.WriteByte(upperHex[b&0x0F])
+	}
+
+	return out.String()
+}
+
+func unescapeKey(escaped string) (string, error) {
+	var out strings.Builder
+	out.Grow(len(escaped))
+
+	for i := 0; i < len(escaped); i++ {
+		b := escaped[i]
+		if b != '%' {
+			if !isSafeKeyByte(b) {
+				return "", fmt.Errorf("invalid byte %q in escaped key at %d", b, i)
+			}
+			out.WriteByte(b)
+			continue
+		}
+
+		if i+2 >= len(escaped) {
+			return "", fmt.Errorf("truncated escape sequence at %d", i)
+		}
+		high, highOK := unhex(escaped[i+1])
+		low, lowOK := unhex(escaped[i+2])
+		if !highOK || !lowOK {
+			return "", fmt.Errorf("invalid escape sequence %q at %d", escaped[i:i+3], i)
+		}
+		out.WriteByte(high<<4 | low)
+		i += 2
+	}
+
+	return out.String(), nil
+}
+
+func isSafeKeyByte(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '.' || b == '_'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	}
+	return 0, false
+}
+
+// encodeFileName returns the file name of an item, codec is the name of the
+// codec the data is encoded with, omitted from the name when it is the
+// identity codec.
+func encodeFileName(key string, t time.Time, codec string) string {
+	name := escapeKey(key) + "-" + t.Format(DateFormat) + FileNameVersion
+	if codec != "" && codec != NoCompression.Name() {
+		name += "." + codec
+	}
+
+	return name
+}
+
+// decodeFileName extracts the key, item date and codec name of a cache file
+// name, in the current or in the legacy format.
+func decodeFileName(name string) (key string, t time.Time, codec string, legacy bool, err error) {
+	codec = NoCompression.Name()
+
+	// Escaped keys never contain a dash, so the first one is the separator
+	if separator := strings.Index(name, "-"); separator != -1 {
+		parts := strings.Split(name[separator+1:], ".")
+		if (len(parts) == 2 || len(parts) == 3) && "."+parts[1] == FileNameVersion {
+			if key, err = unescapeKey(name[:separator]); err != nil {
+				return "", t, "", false, fmt.Errorf("invalid file name %q: %w", name, err)
+			}
+			if len(parts) == 3 {
+				codec = parts[2]
+			}
+
+			t, err = time.Parse(DateFormat, parts[0])
+			return key, t, codec, false, err
+		}
+	}
+
+	// Legacy keys were written as is, so only the last dash is a separator
+	separator := strings.LastIndex(name, "-")
+	if separator == -1 {
+		return "", t, "", true, fmt.Errorf("invalid legacy file name %q, missing date separator", name)
+	}
+
+	t, err = time.Parse(DateFormat, name[separator+1:])
+	return name[:separator], t, codec, true, err
+}
+
+// migrateLegacyFiles renames the files of basePath still using the legacy
+// file name format, updating files in place. It returns the new name of each
+// renamed file keyed by its legacy name.
+func migrateLegacyFiles(basePath string, files map[string]os.FileInfo) map[string]string {
+	renamed := map[string]string{}
+
+	for name := range files {
+		key, t, codec, legacy, err := decodeFileName(name)
+		if err != nil || !legacy {
+			continue
+		}
+
+		newName := encodeFileName(key, t, codec)
+		newPath := path.Join(basePath, newName)
+		if err := os.Rename(path.Join(basePath, name), newPath); err != nil {
+			zlog.Warn("failed to migrate legacy cache file name", zap.String("file", name), zap.Error(err))
+			continue
+		}
+
+		fileInfo, err := os.Stat(newPath)
+		if err != nil {
+			zlog.Warn("failed to stat migrated cache file", zap.String("file", newName), zap.Error(err))
+			continue
+		}
+
+		delete(files, name)
+		files[newName] = fileInfo
+		renamed[name] = newName
+	}
+
+	if len(renamed) > 0 {
+		zlog.Info("migrated legacy cache file names", zap.Int("count", len(renamed)))
+	}
+
+	return renamed
+}
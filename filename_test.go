@@ -0,0 +1,81 @@
+package atm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileName_RoundTrip(t *testing.T) {
+	for _, key := range []string{
+		"key.1",
+		"0001234-abcd",
+		"a/b\\c",
+		"100%-done",
+		"ünïcode key",
+		"",
+		"..",
+	} {
+		t.Run(key, func(t *testing.T) {
+			name := encodeFileName(key, ttime(0), "")
+			require.NotContains(t, name, "/")
+			require.Regexp(t, `^[A-Za-z0-9._%]*-[0-9T]+\.v1$`, name)
+
+			decodedKey, decodedTime, codec, legacy, err := decodeFileName(name)
+			require.NoError(t, err)
+			require.False(t, legacy)
+			require.Equal(t, key, decodedKey)
+			require.Equal(t, ttime(0), decodedTime)
+			require.Equal(t, "none", codec)
+
+			decodedKey, _, codec, _, err = decodeFileName(encodeFileName(key, ttime(0), "zstd"))
+			require.NoError(t, err)
+			require.Equal(t, key, decodedKey)
+			require.Equal(t, "zstd", codec)
+		})
+	}
+}
+
+func TestFileName_DecodeLegacy(t *testing.T) {
+	key, itemDate, _, legacy, err := decodeFileName("0001234-abcd-" + ttime(1).Format(DateFormat))
+	require.NoError(t, err)
+	require.True(t, legacy)
+	require.Equal(t, "0001234-abcd", key)
+	require.Equal(t, ttime(1), itemDate)
+
+	_, _, _, _, err = decodeFileName("no_date")
+	require.Error(t, err)
+	_, _, _, _, err = decodeFileName("bad%2-" + ttime(1).Format(DateFormat) + FileNameVersion)
+	require.Error(t, err)
+	_, _, _, _, err = decodeFileName("one-two-" + ttime(1).Format(DateFormat) + FileNameVersion)
+	require.Error(t, err)
+}
+
+func TestCache_MigrateLegacyFileNames(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+
+	legacyName := "0001234-abcd-" + ttime(1).Format(DateFormat)
+	require.NoError(t, ioutil.WriteFile(path.Join(basePath, legacyName), []byte{1, 2}, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(path.Join(basePath, "key.2-"+ttime(2).Format(DateFormat)), []byte{1}, os.ModePerm))
+
+	cache, err := NewInitializedCache(basePath, 100, 100, NewFileIO())
+	require.NoError(t, err)
+	defer cache.Close(context.Background())
+
+	require.Len(t, cache.index, 2)
+	data, found, err := cache.Read("0001234-abcd")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte{1, 2}, data)
+	require.Contains(t, cache.index, "key.2")
+
+	_, err = os.Stat(path.Join(basePath, legacyName))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(toFilePath(basePath, "0001234-abcd", ttime(1)))
+	require.NoError(t, err)
+}
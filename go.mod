@@ -4,7 +4,11 @@ go 1.16
 
 require (
 	github.com/dustin/go-humanize v1.0.0
+	github.com/klauspost/compress v1.15.9
+	github.com/prometheus/client_golang v1.12.2
 	github.com/streamingfast/logging v0.0.0-20210908162127-bdc5856d5341
 	github.com/stretchr/testify v1.7.0
 	go.uber.org/zap v1.19.1
+	golang.org/x/sys v0.7.0 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
 )
@@ -12,6 +12,7 @@ func ByInsertionTime(h []*CacheItem, i, j int) bool {
 
 type Heap struct {
 	items          []*CacheItem
+	positions      map[string]int
 	sizeInBytes    int
 	maxSizeInBytes int
 	less           func(h []*CacheItem, i, j int) bool
@@ -20,6 +21,7 @@ type Heap struct {
 func NewHeap(less func(h []*CacheItem, i, j int) bool, maxSizeInByte int) *Heap {
 	h := &Heap{
 		items:          []*CacheItem{},
+		positions:      map[string]int{},
 		less:           less,
 		maxSizeInBytes: maxSizeInByte,
 	}
@@ -41,6 +43,8 @@ func (h Heap) Swap(i, j int) {
 	}
 
 	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.positions[h.items[i].key] = i
+	h.positions[h.items[j].key] = j
 }
 
 func (h *Heap) FreeSpace() int {
@@ -49,7 +53,12 @@ func (h *Heap) FreeSpace() int {
 
 func (h *Heap) Push(x interface{}) {
 	cacheItem := x.(*CacheItem)
+	if h.positions == nil {
+		h.positions = map[string]int{}
+	}
+
 	h.sizeInBytes += cacheItem.size
+	h.positions[cacheItem.key] = len(h.items)
 	h.items = append(h.items, cacheItem)
 }
 
@@ -63,6 +72,7 @@ func (h *Heap) Pop() interface{} {
 	ci := old[n-1]
 	h.items = old[0 : n-1]
 	h.sizeInBytes -= ci.size
+	delete(h.positions, ci.key)
 	return ci
 }
 
@@ -78,21 +88,30 @@ func (h *Heap) Peek() *CacheItem {
 	return h.items[0]
 }
 
+func (h *Heap) Contains(key string) bool {
+	_, found := h.positions[key]
+	return found
+}
+
+// Remove takes the item identified by key out of the heap, returning nil when
+// the heap does not hold it. Size accounting is handled by Pop.
 func (h *Heap) Remove(key string) *CacheItem {
-	var foundAtIndex int
-	var found bool
-	for index, cacheIem := range h.items {
-		if cacheIem.key == key {
-			found = true
-			foundAtIndex = index
-		}
+	index, found := h.positions[key]
+	if !found {
+		return nil
 	}
 
+	return heap.Remove(h, index).(*CacheItem)
+}
+
+// Fix restores the heap ordering after the item identified by key changed,
+// returning false when the heap does not hold it.
+func (h *Heap) Fix(key string) bool {
+	index, found := h.positions[key]
 	if !found {
-		return nil
+		return false
 	}
 
-	cacheItem := heap.Remove(h, foundAtIndex).(*CacheItem)
-	h.sizeInBytes -= cacheItem.size
-	return cacheItem
+	heap.Fix(h, index)
+	return true
 }
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHeapPopOrder(t *testing.T) {
@@ -64,3 +65,26 @@ func TestHeapPopOrder(t *testing.T) {
 	assert.Equal(t, res4.(*CacheItem).key, "newest")
 	assert.Nil(t, res5)
 }
+
+func TestHeapRemove(t *testing.T) {
+	h := NewHeap(ByAge, 100)
+
+	for i, key := range []string{"a", "b", "c", "d"} {
+		heap.Push(h, &CacheItem{key: key, size: 2, itemDate: aTime.Add(time.Duration(i) * time.Second)})
+	}
+	require.Equal(t, 8, h.sizeInBytes)
+
+	removed := h.Remove("b")
+	require.NotNil(t, removed)
+	assert.Equal(t, "b", removed.key)
+	assert.Equal(t, 6, h.sizeInBytes)
+	assert.False(t, h.Contains("b"))
+	assert.Nil(t, h.Remove("b"))
+
+	var keys []string
+	for h.Len() > 0 {
+		keys = append(keys, heap.Pop(h).(*CacheItem).key)
+	}
+	assert.Equal(t, []string{"a", "c", "d"}, keys)
+	assert.Equal(t, 0, h.sizeInBytes)
+}
@@ -2,31 +2,107 @@ package atm
 
 import (
 	"fmt"
-	"go.uber.org/zap"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
 )
 
 type CacheIO interface {
 	Write(path string, data []byte) error
 	Read(path string) ([]byte, error)
 	Delete(path string) error
+
+	// WriteFrom streams reader into path and returns the number of bytes written.
+	WriteFrom(path string, reader io.Reader) (int64, error)
+	// OpenReader opens path for streaming reads, the caller must close the reader.
+	OpenReader(path string) (io.ReadCloser, error)
+}
+
+// FileIO stores cache items as files. Files are written to a temporary file of
+// the same directory then renamed in place, so readers never observe a
+// partially written file.
+type FileIO struct {
+	fsync bool
 }
 
-type FileIO struct{}
+type FileIOOption func(f *FileIO)
+
+// WithFsync makes FileIO flush written files, and the directory holding them,
+// to stable storage before considering a write done.
+func WithFsync() FileIOOption {
+	return func(f *FileIO) {
+		f.fsync = true
+	}
+}
+
+func NewFileIO(opts ...FileIOOption) *FileIO {
+	f := &FileIO{}
+	for _, opt := range opts {
+		opt(f)
+	}
 
-func NewFileIO() *FileIO {
-	return &FileIO{}
+	return f
 }
 
 func (f *FileIO) Write(path string, data []byte) error {
-	return ioutil.WriteFile(path, data, os.ModePerm)
+	_, err := f.writeAtomic(path, func(writer io.Writer) (int64, error) {
+		written, err := writer.Write(data)
+		return int64(written), err
+	})
+
+	return err
 }
 
 func (f *FileIO) Read(path string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
+func (f *FileIO) WriteFrom(path string, reader io.Reader) (int64, error) {
+	return f.writeAtomic(path, func(writer io.Writer) (int64, error) {
+		return io.Copy(writer, reader)
+	})
+}
+
+func (f *FileIO) writeAtomic(filePath string, write func(writer io.Writer) (int64, error)) (written int64, err error) {
+	file, err := createTempFile(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("creating temp file: %w", err)
+	}
+
+	written, err = write(file)
+	if err == nil && f.fsync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return 0, err
+	}
+
+	if f.fsync {
+		if err := syncDir(path.Dir(filePath)); err != nil {
+			return 0, fmt.Errorf("syncing directory: %w", err)
+		}
+	}
+
+	return written, nil
+}
+
+func (f *FileIO) OpenReader(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
 func (f *FileIO) Delete(path string) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -43,3 +119,36 @@ func (f *FileIO) Delete(path string) (err error) {
 
 	return
 }
+
+// tempFileSuffix ends the name of every temporary file, which are hidden files
+// named `.<final name>.<random>.tmp~` living next to their final destination.
+// Cache file names end with their item date, the file name version or a codec
+// name, and escaped keys never contain `~`, so both are never confused.
+const tempFileSuffix = ".tmp~"
+
+func createTempFile(finalPath string) (*os.File, error) {
+	prefix := path.Join(path.Dir(finalPath), "."+path.Base(finalPath)+".")
+
+	for attempt := 0; ; attempt++ {
+		file, err := os.OpenFile(prefix+strconv.FormatUint(uint64(rand.Int63()), 36)+tempFileSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
+		if err != nil && os.IsExist(err) && attempt < 10 {
+			continue
+		}
+
+		return file, err
+	}
+}
+
+func isTempFileName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
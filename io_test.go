@@ -0,0 +1,97 @@
+package atm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileIO_WriteAtomic(t *testing.T) {
+	for _, fileIO := range []*FileIO{NewFileIO(), NewFileIO(WithFsync())} {
+		dir := t.TempDir()
+		filePath := path.Join(dir, "item")
+
+		require.NoError(t, fileIO.Write(filePath, []byte("first")))
+		require.NoError(t, fileIO.Write(filePath, []byte("second")))
+
+		data, err := fileIO.Read(filePath)
+		require.NoError(t, err)
+		require.Equal(t, []byte("second"), data)
+
+		written, err := fileIO.WriteFrom(filePath, bytes.NewReader([]byte("streamed")))
+		require.NoError(t, err)
+		require.Equal(t, int64(8), written)
+
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+	}
+}
+
+func TestFileIO_WriteFromFailureKeepsPreviousFile(t *testing.T) {
+	dir := t.TempDir()
+	filePath := path.Join(dir, "item")
+	fileIO := NewFileIO()
+
+	require.NoError(t, fileIO.Write(filePath, []byte("complete")))
+
+	reader := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(errors.New("connection reset")))
+	_, err := fileIO.WriteFrom(filePath, reader)
+	require.Error(t, err)
+
+	data, err := fileIO.Read(filePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("complete"), data)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestCache_InitializeRemovesTempFiles(t *testing.T) {
+	basePath := t.TempDir()
+
+	finalPath := toFilePath(basePath, "key.0", ttime(0))
+	leftover, err := createTempFile(finalPath)
+	require.NoError(t, err)
+	_, err = leftover.Write([]byte("trunc"))
+	require.NoError(t, err)
+	require.NoError(t, leftover.Close())
+
+	cache, err := NewInitializedCache(basePath, 100, 100, NewFileIO(), WithManifestCheckpointInterval(0))
+	require.NoError(t, err)
+	defer cache.Close(context.Background())
+
+	require.Len(t, cache.index, 0)
+	_, err = os.Stat(leftover.Name())
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCache_InitializeKeepsDotKeys(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+
+	cache, err := NewInitializedCache(basePath, 100, 100, NewFileIO(), WithManifestCheckpointInterval(0))
+	require.NoError(t, err)
+	_, err = cache.Write(".cfg.tmp", ttime(0), ttime(0), []byte("data"))
+	require.NoError(t, err)
+	require.False(t, isTempFileName(path.Base(cache.index[".cfg.tmp"].FilePath())))
+	require.NoError(t, cache.Close(context.Background()))
+
+	restored, err := NewInitializedCache(basePath, 100, 100, NewFileIO(), WithManifestCheckpointInterval(0))
+	require.NoError(t, err)
+	defer restored.Close(context.Background())
+
+	data, found, err := restored.Read(".cfg.tmp")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("data"), data)
+}
@@ -0,0 +1,141 @@
+package atm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Loader fetches the data of a cache key from its source of truth.
+type Loader func(ctx context.Context) ([]byte, error)
+
+// GetOrLoad returns the cached data of key, calling loader on a miss and
+// writing its result to the cache with itemDate. Concurrent misses on the same
+// key are collapsed into a single loader call, every waiter receiving the same
+// byte slice, which must therefore not be mutated. The shared loader call runs
+// in the background with the values of the ctx of the caller starting it, but
+// not its deadline or cancellation, each caller, the first one included, stops
+// waiting when its own ctx is done. A panicking loader fails the load.
+// opts apply to the loaded item written to the cache.
+func (c *Cache) GetOrLoad(ctx context.Context, key string, itemDate time.Time, loader Loader, opts ...WriteOption) ([]byte, error) {
+	data, found, err := c.Read(key)
+	if err != nil && !errors.Is(err, ErrCorrupted) {
+		return nil, fmt.Errorf("reading %q: %w", key, err)
+	}
+	if found {
+		return data, nil
+	}
+
+	loadCtx := detachedContext{parent: ctx}
+	return c.loads.do(ctx, key, func() ([]byte, error) {
+		// A previous flight for the same key might have completed between our
+		// read and now, only the index is looked up so the miss is not recorded
+		// twice
+		if c.indexed(key) {
+			if data, found, err := c.Read(key); err == nil && found {
+				return data, nil
+			}
+		}
+
+		data, err := loader(loadCtx)
+		if err != nil {
+			return nil, fmt.Errorf("loading %q: %w", key, err)
+		}
+
+		if _, err := c.Write(key, itemDate, time.Now(), data, opts...); err != nil && !errors.Is(err, ErrNotAdmitted) {
+			zlog.Warn("failed to write loaded item to cache", zap.String("key", key), zap.Error(err))
+		}
+
+		return data, nil
+	})
+}
+
+// indexed reports whether key is cached, without recording the lookup.
+func (c *Cache) indexed(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cacheItem, found := c.index[key]
+	return found && !c.closed && !cacheItem.expired(c.now())
+}
+
+type loadCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// loadGroup deduplicates concurrent loads of the same key.
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+// do runs fn in the background unless a load of key is already in flight,
+// then waits for the load to complete or for ctx to be done.
+func (g *loadGroup) do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*loadCall{}
+	}
+
+	call, found := g.calls[key]
+	if !found {
+		call = &loadCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go g.run(key, call, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.data, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *loadGroup) run(key string, call *loadCall, fn func() ([]byte, error)) {
+	// Waiters must be released even when fn panics, no caller is left to
+	// receive the panic so it fails the load
+	defer func() {
+		if r := recover(); r != nil {
+			zlog.Error("loader panicked", zap.String("key", key), zap.Any("panic", r))
+			call.data, call.err = nil, fmt.Errorf("loading %q: loader panicked: %v", key, r)
+		}
+		close(call.done)
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+	}()
+
+	call.data, call.err = fn()
+}
+
+// detachedContext carries the values of its parent without its deadline and
+// cancellation, so a load shared by several callers outlives the one which
+// started it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (d detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (d detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (d detachedContext) Err() error {
+	return nil
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
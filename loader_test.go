@@ -0,0 +1,217 @@
+package atm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_GetOrLoad(t *testing.T) {
+	SystemBlockSize = 0
+
+	var written int32
+	cacheIO := newTestCacheIO()
+	cacheIO.writeFunc = func(path string, data []byte) error {
+		atomic.AddInt32(&written, 1)
+		return nil
+	}
+	cacheIO.readFunc = func(path string) ([]byte, error) {
+		return []byte("loaded"), nil
+	}
+	cache := NewCache("/tmp", 100, 100, cacheIO)
+
+	var loaderCalls int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&loaderCalls, 1)
+		<-release
+		return []byte("loaded"), nil
+	}
+
+	const waiters = 10
+	results := make([][]byte, waiters)
+	wg := sync.WaitGroup{}
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := cache.GetOrLoad(context.Background(), "key.0", ttime(0), loader)
+			assert.NoError(t, err)
+			results[i] = data
+		}(i)
+	}
+
+	// Give waiters a chance to pile up on the in-flight load
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&loaderCalls))
+	require.Equal(t, int32(1), atomic.LoadInt32(&written))
+	for _, result := range results {
+		require.Equal(t, []byte("loaded"), result)
+	}
+
+	data, err := cache.GetOrLoad(context.Background(), "key.0", ttime(0), loader)
+	require.NoError(t, err)
+	require.Equal(t, []byte("loaded"), data)
+	require.Equal(t, int32(1), atomic.LoadInt32(&loaderCalls))
+}
+
+func TestCache_GetOrLoad_Corrupted(t *testing.T) {
+	cacheIO := newTestCacheIO()
+	cache := NewCache("/tmp", 100, 100, cacheIO)
+
+	_, err := cache.Write("key.0", ttime(0), ttime(0), []byte("original"))
+	require.NoError(t, err)
+	require.NoError(t, cacheIO.Write(toFilePath("/tmp", "key.0", ttime(0)), []byte("rotten")))
+
+	data, err := cache.GetOrLoad(context.Background(), "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+		return []byte("refetched"), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("refetched"), data)
+
+	data, found, err := cache.Read("key.0")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("refetched"), data)
+}
+
+func TestCache_GetOrLoad_LoaderError(t *testing.T) {
+	cache := NewCache("/tmp", 100, 100, newTestCacheIO())
+
+	_, err := cache.GetOrLoad(context.Background(), "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+		return nil, errors.New("bucket unavailable")
+	})
+	require.Error(t, err)
+
+	_, found, err := cache.Read("key.0")
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestCache_GetOrLoad_WaiterContextCanceled(t *testing.T) {
+	cache := NewCache("/tmp", 100, 100, newTestCacheIO())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loaded := make(chan struct{})
+	go func() {
+		defer close(loaded)
+		_, _ = cache.GetOrLoad(context.Background(), "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+			close(started)
+			<-release
+			return []byte("loaded"), nil
+		})
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cache.GetOrLoad(ctx, "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+		t.Fatal("loader must not be called while another load is in flight")
+		return nil, nil
+	})
+	require.Equal(t, context.Canceled, err)
+	close(release)
+	<-loaded
+}
+
+func TestCache_GetOrLoad_FirstCallerCanceled(t *testing.T) {
+	cache := NewCache("/tmp", 100, 100, newTestCacheIO())
+
+	type ctxKey struct{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	firstCtx, cancelFirst := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "first"))
+
+	firstDone := make(chan error)
+	go func() {
+		_, err := cache.GetOrLoad(firstCtx, "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+			assert.Equal(t, "first", ctx.Value(ctxKey{}))
+			close(started)
+			<-release
+			return []byte("loaded"), ctx.Err()
+		})
+		firstDone <- err
+	}()
+	<-started
+
+	waiterDone := make(chan []byte)
+	go func() {
+		data, err := cache.GetOrLoad(context.Background(), "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+			return nil, errors.New("loader must not be called while another load is in flight")
+		})
+		assert.NoError(t, err)
+		waiterDone <- data
+	}()
+
+	// The caller which started the load stops waiting, the load goes on for
+	// the other callers
+	cancelFirst()
+	require.Equal(t, context.Canceled, <-firstDone)
+	close(release)
+	require.Equal(t, []byte("loaded"), <-waiterDone)
+}
+
+func TestCache_GetOrLoad_LoaderPanic(t *testing.T) {
+	cache := NewCache("/tmp", 100, 100, newTestCacheIO())
+
+	_, err := cache.GetOrLoad(context.Background(), "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+		panic("boom")
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "loader panicked: boom")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, err := cache.GetOrLoad(ctx, "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+		return []byte("loaded"), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("loaded"), data)
+}
+
+func TestCache_GetOrLoad_RecordsSingleMiss(t *testing.T) {
+	cache := NewCache("/tmp", 100, 100, newTestCacheIO(), WithAdmissionFilter(100))
+
+	_, err := cache.GetOrLoad(context.Background(), "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+		return []byte("loaded"), nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(1), cache.Stats().Misses)
+	require.Equal(t, uint8(1), cache.admission.estimate("key.0"))
+}
+
+func TestCache_GetOrLoad_CorruptedRewriteDuringDelete(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	cache := NewCache("/cache", 100, 100, &slowDeleteIO{CacheIO: store, delay: 20 * time.Millisecond})
+	defer cache.Close(context.Background())
+
+	_, err := cache.Write("key.0", ttime(0), ttime(0), []byte("original"))
+	require.NoError(t, err)
+	require.NoError(t, store.Write(cache.toFilePath("key.0", ttime(0)), []byte("rotten")))
+
+	data, err := cache.GetOrLoad(context.Background(), "key.0", ttime(0), func(ctx context.Context) ([]byte, error) {
+		return []byte("refetched"), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("refetched"), data)
+
+	time.Sleep(40 * time.Millisecond)
+	data, found, err := cache.Read("key.0")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("refetched"), data)
+	requireConsistent(t, cache, store)
+}
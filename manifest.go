@@ -0,0 +1,257 @@
+package atm
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ManifestFileName is the name of the file, in the cache base path, holding
+// the last checkpoint of the cache index.
+const ManifestFileName = ".atm-manifest"
+
+const DefaultManifestCheckpointInterval = time.Minute
+
+const manifestVersion = 1
+
+const (
+	heapRecent     = "recent"
+	heapAge        = "age"
+	heapReversible = "reversible"
+)
+
+type manifestHeader struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Count     int       `json:"count"`
+}
+
+// manifestItem is one line of the manifest, files are referenced by name
+// relative to the cache base path.
+type manifestItem struct {
+	Key        string    `json:"key"`
+	File       string    `json:"file"`
+	Size       int       `json:"size"`
+	ItemDate   time.Time `json:"item_date"`
+	InsertedAt time.Time `json:"inserted_at"`
+	// LastAccessedAt is only set when the item was read since its insertion
+	LastAccessedAt *time.Time `json:"last_accessed_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Heap           string     `json:"heap"`
+	Checksum       *uint32    `json:"checksum,omitempty"`
+	Codec          string     `json:"codec,omitempty"`
+}
+
+func (c *Cache) manifestPath() string {
+	return path.Join(c.basePath, ManifestFileName)
+}
+
+func (c *Cache) checkpointLoop() {
+	ticker := time.NewTicker(c.manifestCheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.checkpoint(); err != nil {
+				zlog.Warn("failed to checkpoint cache manifest", zap.Error(err))
+			}
+		}
+	}
+}
+
+// checkpoint writes a snapshot of the index to the manifest file. The
+// snapshot is taken under the read lock, the file is written without it.
+func (c *Cache) checkpoint() error {
+	c.mu.RLock()
+	items := make([]manifestItem, 0, len(c.index))
+	for _, cacheItem := range c.index {
+		heapName := ""
+		if cacheItem.reversible {
+			heapName = heapReversible
+		} else if policy, ok := c.policy.(tieredPolicy); ok && !cacheItem.pinned {
+			heapName = policy.tierOf(cacheItem)
+		}
+
+		item := manifestItem{
+			Key:        cacheItem.key,
+			File:       path.Base(cacheItem.filePath),
+			Size:       cacheItem.size,
+			ItemDate:   cacheItem.itemDate,
+			InsertedAt: cacheItem.insertedAt,
+			Heap:       heapName,
+			Codec:      cacheItem.codec.Name(),
+		}
+		if cacheItem.checksummed {
+			checksum := cacheItem.checksum
+			item.Checksum = &checksum
+		}
+		if !cacheItem.lastAccessedAt.Equal(cacheItem.insertedAt) {
+			lastAccessedAt := cacheItem.lastAccessedAt
+			item.LastAccessedAt = &lastAccessedAt
+		}
+		if !cacheItem.expiresAt.IsZero() {
+			expiresAt := cacheItem.expiresAt
+			item.ExpiresAt = &expiresAt
+		}
+
+		items = append(items, item)
+	}
+	c.mu.RUnlock()
+
+	start := time.Now()
+	if err := writeManifest(c.manifestPath(), items); err != nil {
+		return err
+	}
+
+	zlog.Debug("cache manifest checkpointed", zap.Int("item_count", len(items)), zap.Duration("elapsed", time.Since(start)))
+	return nil
+}
+
+func writeManifest(filePath string, items []manifestItem) error {
+	tmp, err := createTempFile(filePath)
+	if err != nil {
+		return fmt.Errorf("creating manifest temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+
+	err = encoder.Encode(manifestHeader{Version: manifestVersion, CreatedAt: time.Now(), Count: len(items)})
+	for i := 0; err == nil && i < len(items); i++ {
+		err = encoder.Encode(items[i])
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// readManifest returns the items of the manifest at filePath, a missing
+// manifest yields no items and no error.
+func readManifest(filePath string) ([]manifestItem, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+
+	var header manifestHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, fmt.Errorf("decoding manifest header: %w", err)
+	}
+	if header.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", header.Version)
+	}
+
+	items := make([]manifestItem, 0, header.Count)
+	for {
+		var item manifestItem
+		err := decoder.Decode(&item)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding manifest item %d: %w", len(items), err)
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// restoreFromManifest re-indexes the manifest items whose file is still
+// present in files, putting them back in the heap they were checkpointed in.
+// Restored file names are removed from files so only the files added since the
+// checkpoint are left in it. Manifest items referencing a file renamed by the
+// file name migration are looked up through renamed.
+func (c *Cache) restoreFromManifest(files map[string]os.FileInfo, renamed map[string]string) error {
+	items, err := readManifest(c.manifestPath())
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	restored := 0
+	for _, item := range items {
+		if newName, found := renamed[item.File]; found {
+			item.File = newName
+		}
+
+		if _, found := files[item.File]; !found {
+			zlog.Debug("skipping manifest item without file", zap.String("key", item.Key), zap.String("file", item.File))
+			continue
+		}
+		delete(files, item.File)
+
+		if _, found := c.index[item.Key]; found {
+			continue
+		}
+
+		codec := NoCompression
+		if item.Codec != "" {
+			if codec, err = codecByName(item.Codec); err != nil {
+				zlog.Warn("skipping manifest item with unknown codec", zap.String("key", item.Key), zap.Error(err))
+				continue
+			}
+		}
+
+		cacheItem := newCacheItem(item.Key, path.Join(c.basePath, item.File), item.Size, item.ItemDate, item.InsertedAt)
+		cacheItem.codec = codec
+		if item.Checksum != nil {
+			cacheItem.setChecksum(*item.Checksum)
+		}
+		if item.LastAccessedAt != nil {
+			cacheItem.lastAccessedAt = *item.LastAccessedAt
+		}
+		if item.ExpiresAt != nil {
+			cacheItem.expiresAt = *item.ExpiresAt
+		}
+		c.index[cacheItem.key] = cacheItem
+		c.blocks.add(cacheItem.key)
+		c.trackExpiryWithLock(cacheItem)
+		if item.Heap == heapReversible && c.reversible != nil {
+			cacheItem.reversible = true
+			heap.Push(c.reversible, cacheItem)
+		} else if policy, ok := c.policy.(tieredPolicy); ok {
+			policy.restore(cacheItem, item.Heap)
+		} else {
+			c.applyEvictionsWithLock(c.policy.Victims(cacheItem.size))
+			c.policy.OnInsert(cacheItem)
+		}
+		restored++
+	}
+
+	if policy, ok := c.policy.(tieredPolicy); ok {
+		c.applyEvictionsWithLock(policy.trim())
+	}
+	c.trimReversibleWithLock()
+
+	zlog.Info("restored cache items from manifest", zap.Int("manifest_count", len(items)), zap.Int("restored_count", restored))
+	return nil
+}
@@ -0,0 +1,117 @@
+package atm
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_ManifestRestore(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+
+	cache, err := NewInitializedCache(basePath, 6, 6, NewFileIO())
+	require.NoError(t, err)
+
+	for i, testItem := range []*testItem{
+		newTestItem("key.0", 2, 3),
+		newTestItem("key.1", 1, 3),
+		newTestItem("key.2", 0, 3),
+	} {
+		_, err := cache.Write(testItem.key, testItem.itemDate, ttime(i), testItem.data)
+		require.NoError(t, err)
+	}
+	require.True(t, recentAge(cache).ageHeap.Contains("key.0"))
+	require.NoError(t, cache.Close(context.Background()))
+
+	_, err = os.Stat(path.Join(basePath, ManifestFileName))
+	require.NoError(t, err)
+
+	// A file added and one removed behind the back of the manifest
+	require.NoError(t, ioutil.WriteFile(toFilePath(basePath, "key.3", ttime(3)), []byte{1}, os.ModePerm))
+	require.NoError(t, os.Remove(toFilePath(basePath, "key.1", ttime(1))))
+
+	restored, err := NewInitializedCache(basePath, 6, 6, NewFileIO())
+	require.NoError(t, err)
+	defer restored.Close(context.Background())
+
+	require.Len(t, restored.index, 3)
+	require.True(t, recentAge(restored).ageHeap.Contains("key.0"))
+	require.True(t, recentAge(restored).recentEntryHeap.Contains("key.2"))
+	require.True(t, recentAge(restored).recentEntryHeap.Contains("key.3"))
+	require.NotContains(t, restored.index, "key.1")
+
+	require.Equal(t, ttime(2), restored.index["key.2"].insertedAt.UTC())
+	require.Equal(t, 3, restored.index["key.0"].size)
+	require.Equal(t, 6-3, recentAge(restored).ageHeap.FreeSpace())
+
+	require.True(t, restored.index["key.0"].checksummed)
+	require.False(t, restored.index["key.3"].checksummed)
+	data, found, err := restored.Read("key.0")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte{0, 0, 0}, data)
+}
+
+func TestCache_ManifestRestore_ShrunkBudget(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+
+	cache, err := NewInitializedCache(basePath, 6, 6, NewFileIO())
+	require.NoError(t, err)
+	for i, testItem := range []*testItem{
+		newTestItem("key.0", 0, 3),
+		newTestItem("key.1", 1, 3),
+	} {
+		_, err := cache.Write(testItem.key, testItem.itemDate, ttime(i), testItem.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, cache.Close(context.Background()))
+
+	restored, err := NewInitializedCache(basePath, 3, 0, NewFileIO())
+	require.NoError(t, err)
+	require.NoError(t, restored.Close(context.Background()))
+
+	require.Len(t, restored.index, 1)
+	require.True(t, recentAge(restored).recentEntryHeap.Contains("key.1"))
+	_, err = os.Stat(toFilePath(basePath, "key.0", ttime(0)))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCache_ManifestCorrupted(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+
+	require.NoError(t, ioutil.WriteFile(toFilePath(basePath, "key.0", ttime(0)), []byte{1}, os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(path.Join(basePath, ManifestFileName), []byte("{not json"), os.ModePerm))
+
+	cache, err := NewInitializedCache(basePath, 6, 6, NewFileIO(), WithManifestCheckpointInterval(0))
+	require.NoError(t, err)
+	defer cache.Close(context.Background())
+
+	require.Contains(t, cache.index, "key.0")
+}
+
+func TestCache_CloseWaitsForCheckpoints(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+
+	cache, err := NewInitializedCache(basePath, 10_000, 10_000, NewFileIO(), WithManifestCheckpointInterval(time.Millisecond))
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		_, err := cache.Write(fmt.Sprintf("key.%d", i), ttime(i), ttime(i), []byte{1})
+		require.NoError(t, err)
+	}
+	require.NoError(t, cache.Close(context.Background()))
+
+	items, err := readManifest(path.Join(basePath, ManifestFileName))
+	require.NoError(t, err)
+	require.Len(t, items, 50)
+}
@@ -0,0 +1,168 @@
+package atm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrMemoryFull is returned by MemoryIO when storing data would go over its
+// byte limit.
+var ErrMemoryFull = errors.New("memory io byte limit reached")
+
+// MemoryIO is a CacheIO keeping data in memory, for tests, ephemeral
+// deployments or as the front tier of a layered cache. Missing paths fail
+// with an error matching os.ErrNotExist, like FileIO.
+type MemoryIO struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+	size  int64
+
+	maxBytes     int64
+	readLatency  time.Duration
+	writeLatency time.Duration
+}
+
+type MemoryIOOption func(m *MemoryIO)
+
+// WithMemoryLatency delays every read and write operation, to mimic a slower
+// storage.
+func WithMemoryLatency(read, write time.Duration) MemoryIOOption {
+	return func(m *MemoryIO) {
+		m.readLatency = read
+		m.writeLatency = write
+	}
+}
+
+// WithMemoryMaxBytes caps the amount of data MemoryIO holds, writes going
+// over fail with ErrMemoryFull.
+func WithMemoryMaxBytes(maxBytes int64) MemoryIOOption {
+	return func(m *MemoryIO) {
+		m.maxBytes = maxBytes
+	}
+}
+
+func NewMemoryIO(opts ...MemoryIOOption) *MemoryIO {
+	m := &MemoryIO{files: map[string][]byte{}}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+func (m *MemoryIO) Write(path string, data []byte) error {
+	m.sleep(m.writeLatency)
+	return m.store(path, append([]byte(nil), data...))
+}
+
+func (m *MemoryIO) WriteFrom(path string, reader io.Reader) (int64, error) {
+	m.sleep(m.writeLatency)
+
+	if m.maxBytes > 0 {
+		// Reading one byte more than the limit is enough to know the data won't fit
+		reader = io.LimitReader(reader, m.maxBytes+1)
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := m.store(path, data); err != nil {
+		return 0, err
+	}
+
+	return int64(len(data)), nil
+}
+
+func (m *MemoryIO) store(path string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newSize := m.size - int64(len(m.files[path])) + int64(len(data))
+	if m.maxBytes > 0 && newSize > m.maxBytes {
+		return fmt.Errorf("writing %d bytes to %s: %w", len(data), path, ErrMemoryFull)
+	}
+
+	m.files[path] = data
+	m.size = newSize
+	return nil
+}
+
+func (m *MemoryIO) Read(path string) ([]byte, error) {
+	m.sleep(m.readLatency)
+
+	data, err := m.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+func (m *MemoryIO) OpenReader(path string) (io.ReadCloser, error) {
+	m.sleep(m.readLatency)
+
+	// Stored data is never mutated, overwrites replace the slice, so it can be
+	// shared with the reader
+	data, err := m.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MemoryIO) load(path string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, found := m.files[path]
+	if !found {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+
+	return data, nil
+}
+
+func (m *MemoryIO) Delete(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, found := m.files[path]
+	if !found {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+
+	delete(m.files, path)
+	m.size -= int64(len(data))
+	return nil
+}
+
+// Size returns the number of bytes currently held.
+func (m *MemoryIO) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.size
+}
+
+// Len returns the number of paths currently held.
+func (m *MemoryIO) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.files)
+}
+
+func (m *MemoryIO) sleep(latency time.Duration) {
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
@@ -0,0 +1,87 @@
+package atm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryIO(t *testing.T) {
+	memoryIO := NewMemoryIO(WithMemoryMaxBytes(10))
+
+	data := []byte("12345")
+	require.NoError(t, memoryIO.Write("a", data))
+	data[0] = 'x'
+
+	read, err := memoryIO.Read("a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("12345"), read)
+
+	written, err := memoryIO.WriteFrom("b", bytes.NewReader([]byte("6789")))
+	require.NoError(t, err)
+	require.Equal(t, int64(4), written)
+	require.Equal(t, int64(9), memoryIO.Size())
+	require.Equal(t, 2, memoryIO.Len())
+
+	err = memoryIO.Write("c", []byte("ab"))
+	require.True(t, errors.Is(err, ErrMemoryFull))
+	_, err = memoryIO.WriteFrom("c", bytes.NewReader(bytes.Repeat([]byte("a"), 100)))
+	require.True(t, errors.Is(err, ErrMemoryFull))
+
+	// Overwriting only accounts for the difference
+	require.NoError(t, memoryIO.Write("a", []byte("123456")))
+	require.Equal(t, int64(10), memoryIO.Size())
+
+	reader, err := memoryIO.OpenReader("b")
+	require.NoError(t, err)
+	read, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, []byte("6789"), read)
+
+	require.NoError(t, memoryIO.Delete("a"))
+	require.Equal(t, int64(4), memoryIO.Size())
+
+	_, err = memoryIO.Read("a")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = memoryIO.OpenReader("a")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	require.True(t, errors.Is(memoryIO.Delete("a"), os.ErrNotExist))
+}
+
+func TestMemoryIO_Latency(t *testing.T) {
+	memoryIO := NewMemoryIO(WithMemoryLatency(20*time.Millisecond, 10*time.Millisecond))
+
+	start := time.Now()
+	require.NoError(t, memoryIO.Write("a", []byte("data")))
+	require.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	start = time.Now()
+	_, err := memoryIO.Read("a")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+}
+
+func TestCache_MemoryIO(t *testing.T) {
+	SystemBlockSize = 0
+	memoryIO := NewMemoryIO()
+
+	cache := NewCache("/cache", 10, 10, memoryIO)
+	defer cache.Close(context.Background())
+
+	for i := 0; i < 5; i++ {
+		_, err := cache.Write(string(rune('a'+i)), ttime(i), ttime(i), []byte("12345"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, cache.Close(context.Background()))
+
+	// Items evicted out of both heaps are removed from memory
+	require.Equal(t, 4, memoryIO.Len())
+	require.Equal(t, int64(20), memoryIO.Size())
+}
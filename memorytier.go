@@ -0,0 +1,189 @@
+package atm
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+// memoryTier keeps the decoded data of recently read or written items in
+// memory, evicting the least recently used ones past its byte budget. Entries
+// are bound to the CacheItem they were read from, the cache removes them as
+// soon as the item leaves its index.
+type memoryTier struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type memoryEntry struct {
+	item *CacheItem
+	data []byte
+}
+
+func newMemoryTier(maxBytes int) *memoryTier {
+	return &memoryTier{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// get returns the data held for item, a nil tier holds nothing.
+func (m *memoryTier) get(item *CacheItem) ([]byte, bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, found := m.entries[item.key]
+	if !found || element.Value.(*memoryEntry).item != item {
+		return nil, false
+	}
+
+	m.lru.MoveToFront(element)
+	return element.Value.(*memoryEntry).data, true
+}
+
+// add holds data for item, data must not be modified afterward. Data larger
+// than the whole budget is not held.
+func (m *memoryTier) add(item *CacheItem, data []byte) {
+	if m == nil || len(data) > m.maxBytes {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeWithLock(item.key)
+	m.entries[item.key] = m.lru.PushFront(&memoryEntry{item: item, data: data})
+	m.size += len(data)
+
+	for m.size > m.maxBytes {
+		m.removeWithLock(m.lru.Back().Value.(*memoryEntry).item.key)
+	}
+}
+
+func (m *memoryTier) remove(key string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeWithLock(key)
+}
+
+func (m *memoryTier) removeWithLock(key string) {
+	element, found := m.entries[key]
+	if !found {
+		return
+	}
+
+	m.lru.Remove(element)
+	delete(m.entries, key)
+	m.size -= len(element.Value.(*memoryEntry).data)
+}
+
+func (m *memoryTier) clear() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = map[string]*list.Element{}
+	m.lru.Init()
+	m.size = 0
+}
+
+func (m *memoryTier) stats() (count int, size int) {
+	if m == nil {
+		return 0, 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries), m.size
+}
+
+// readMemory returns the data of key when held by the memory tier.
+func (c *Cache) readMemory(key string) ([]byte, bool) {
+	cacheItem, data, found := c.lookupMemory(key)
+	if !found {
+		return nil, false
+	}
+
+	c.recordAccess(cacheItem)
+	return data, true
+}
+
+func (c *Cache) lookupMemory(key string) (*CacheItem, []byte, bool) {
+	if c.memory == nil {
+		return nil, nil, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cacheItem, found := c.index[key]
+	if c.closed || !found || cacheItem.expired(c.now()) {
+		return nil, nil, false
+	}
+
+	data, found := c.memory.get(cacheItem)
+	if !found {
+		return nil, nil, false
+	}
+
+	atomic.AddUint64(&c.stats.hits, 1)
+	atomic.AddUint64(&c.stats.memoryHits, 1)
+	return cacheItem, data, true
+}
+
+// readMemoryCopy returns a copy of the data of key held by the memory tier,
+// callers are free to modify it.
+func (c *Cache) readMemoryCopy(key string) ([]byte, bool) {
+	data, found := c.readMemory(key)
+	if !found {
+		return nil, false
+	}
+
+	return append([]byte(nil), data...), true
+}
+
+func (c *Cache) openMemoryReader(key string) (io.ReadCloser, bool) {
+	data, found := c.readMemory(key)
+	if !found {
+		return nil, false
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), true
+}
+
+// populateMemory holds a copy of data in the memory tier, unless cacheItem
+// left the index in the meantime.
+func (c *Cache) populateMemory(cacheItem *CacheItem, data []byte) {
+	if c.memory == nil {
+		return
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed || c.index[cacheItem.key] != cacheItem {
+		return
+	}
+
+	c.memory.add(cacheItem, append([]byte(nil), data...))
+}
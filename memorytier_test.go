@@ -0,0 +1,107 @@
+package atm
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryTier(t *testing.T) {
+	tier := newMemoryTier(10)
+	a, b, c := &CacheItem{key: "a"}, &CacheItem{key: "b"}, &CacheItem{key: "c"}
+
+	tier.add(a, []byte("1234"))
+	tier.add(b, []byte("1234"))
+	_, found := tier.get(a)
+	require.True(t, found)
+
+	// b is the least recently used
+	tier.add(c, []byte("1234"))
+	_, found = tier.get(b)
+	require.False(t, found)
+
+	count, size := tier.stats()
+	require.Equal(t, 2, count)
+	require.Equal(t, 8, size)
+
+	// Entries are bound to the item they were read from
+	_, found = tier.get(&CacheItem{key: "a"})
+	require.False(t, found)
+
+	tier.add(b, bytes.Repeat([]byte("1"), 11))
+	_, found = tier.get(b)
+	require.False(t, found)
+
+	tier.remove("a")
+	count, size = tier.stats()
+	require.Equal(t, 1, count)
+	require.Equal(t, 4, size)
+
+	var disabled *memoryTier
+	disabled.add(a, []byte("1234"))
+	_, found = disabled.get(a)
+	require.False(t, found)
+}
+
+func TestCache_MemoryTier(t *testing.T) {
+	SystemBlockSize = 0
+	faultyIO := NewFaultyIO(NewMemoryIO(), 1)
+	cache := NewCache("/cache", 10, 10, faultyIO, WithMemoryTier(100))
+	defer cache.Close(context.Background())
+
+	_, err := cache.Write("a", ttime(0), ttime(0), []byte("12345"))
+	require.NoError(t, err)
+	_, err = cache.WriteFrom("b", ttime(1), ttime(1), bytes.NewReader([]byte("67890")))
+	require.NoError(t, err)
+
+	// Written data is served from memory, streamed data is read once from the CacheIO
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultRead, PathPattern: "a-*"}))
+	require.NoError(t, faultyIO.AddRule(FaultRule{Op: FaultRead, PathPattern: "b-*", Nth: 2}))
+	for i := 0; i < 3; i++ {
+		for key, expected := range map[string]string{"a": "12345", "b": "67890"} {
+			data, found, err := cache.Read(key)
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, []byte(expected), data)
+		}
+	}
+
+	data, _, err := cache.Read("a")
+	require.NoError(t, err)
+	data[0] = 'x'
+
+	reader, found, err := cache.OpenReader("a")
+	require.NoError(t, err)
+	require.True(t, found)
+	data, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, []byte("12345"), data)
+
+	stats := cache.Stats()
+	require.Equal(t, uint64(7), stats.MemoryHits)
+	require.Equal(t, uint64(8), stats.Hits)
+	require.Equal(t, 2, stats.MemoryItemCount)
+	require.Equal(t, 10, stats.MemoryBytes)
+
+	// Evicted and deleted items leave the memory tier with the disk tier
+	for i, key := range []string{"c", "d", "e"} {
+		_, err := cache.Write(key, ttime(i+2), ttime(i+2), []byte("12345"))
+		require.NoError(t, err)
+	}
+	_, found, err = cache.Read("a")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	_, err = cache.Delete("e")
+	require.NoError(t, err)
+	_, found, err = cache.Read("e")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	stats = cache.Stats()
+	require.Equal(t, 3, stats.MemoryItemCount)
+	require.Equal(t, 3, stats.ItemCount)
+}
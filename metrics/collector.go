@@ -0,0 +1,121 @@
+// Package metrics exposes the statistics of an atm.Cache to Prometheus.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streamingfast/atm"
+)
+
+// Collector is a prometheus.Collector reading the statistics of an atm.Cache
+// each time it is scraped.
+type Collector struct {
+	cache *atm.Cache
+
+	hits           *prometheus.Desc
+	misses         *prometheus.Desc
+	memoryHits     *prometheus.Desc
+	memoryItems    *prometheus.Desc
+	memoryBytes    *prometheus.Desc
+	items          *prometheus.Desc
+	heapItems      *prometheus.Desc
+	heapBytes      *prometheus.Desc
+	evictions      *prometheus.Desc
+	deleteFailures *prometheus.Desc
+	corruptions    *prometheus.Desc
+	expirations    *prometheus.Desc
+	rejections     *prometheus.Desc
+	reorgBlocks    *prometheus.Desc
+	reorgBytes     *prometheus.Desc
+	ioLatency      *prometheus.Desc
+}
+
+// NewCollector creates a Collector for cache, metrics are named
+// `<namespace>_cache_<name>` and carry constLabels, typically used to tell
+// deployments apart.
+func NewCollector(cache *atm.Cache, namespace string, constLabels prometheus.Labels) *Collector {
+	desc := func(name, help string, variableLabels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", name), help, variableLabels, constLabels)
+	}
+
+	return &Collector{
+		cache:          cache,
+		hits:           desc("hits_total", "Number of reads served from the cache."),
+		misses:         desc("misses_total", "Number of reads of keys not present in the cache."),
+		memoryHits:     desc("memory_hits_total", "Number of reads served from the memory tier."),
+		memoryItems:    desc("memory_items", "Number of items held by the memory tier."),
+		memoryBytes:    desc("memory_bytes", "Bytes held by the memory tier."),
+		items:          desc("items", "Number of items in the cache index."),
+		heapItems:      desc("heap_items", "Number of items held by a cache heap.", "heap"),
+		heapBytes:      desc("heap_bytes", "Estimated on-disk bytes held by a cache heap.", "heap"),
+		evictions:      desc("evictions_total", "Number of items pushed out of a cache heap.", "heap"),
+		deleteFailures: desc("delete_failures_total", "Number of failed file deletions."),
+		corruptions:    desc("corruptions_total", "Number of reads that failed checksum verification."),
+		expirations:    desc("expirations_total", "Number of items removed because their TTL elapsed."),
+		rejections:     desc("admission_rejections_total", "Number of writes refused by the admission filter."),
+		reorgBlocks:    desc("reorg_blocks_total", "Number of blocks invalidated by chain reorganizations."),
+		reorgBytes:     desc("reorg_bytes_total", "Estimated on-disk bytes of the blocks invalidated by chain reorganizations."),
+		ioLatency:      desc("io_latency_seconds", "Latency of the cache IO operations.", "operation"),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.memoryHits
+	ch <- c.memoryItems
+	ch <- c.memoryBytes
+	ch <- c.items
+	ch <- c.heapItems
+	ch <- c.heapBytes
+	ch <- c.evictions
+	ch <- c.deleteFailures
+	ch <- c.corruptions
+	ch <- c.expirations
+	ch <- c.rejections
+	ch <- c.reorgBlocks
+	ch <- c.reorgBytes
+	ch <- c.ioLatency
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.items, prometheus.GaugeValue, float64(stats.ItemCount))
+
+	ch <- prometheus.MustNewConstMetric(c.memoryHits, prometheus.CounterValue, float64(stats.MemoryHits))
+	ch <- prometheus.MustNewConstMetric(c.memoryItems, prometheus.GaugeValue, float64(stats.MemoryItemCount))
+	ch <- prometheus.MustNewConstMetric(c.memoryBytes, prometheus.GaugeValue, float64(stats.MemoryBytes))
+
+	ch <- prometheus.MustNewConstMetric(c.heapItems, prometheus.GaugeValue, float64(stats.RecentEntryCount), "recent")
+	ch <- prometheus.MustNewConstMetric(c.heapItems, prometheus.GaugeValue, float64(stats.AgeCount), "age")
+	ch <- prometheus.MustNewConstMetric(c.heapItems, prometheus.GaugeValue, float64(stats.PinnedCount), "pinned")
+	ch <- prometheus.MustNewConstMetric(c.heapItems, prometheus.GaugeValue, float64(stats.ReversibleCount), "reversible")
+	ch <- prometheus.MustNewConstMetric(c.heapBytes, prometheus.GaugeValue, float64(stats.RecentEntryBytes), "recent")
+	ch <- prometheus.MustNewConstMetric(c.heapBytes, prometheus.GaugeValue, float64(stats.AgeBytes), "age")
+	ch <- prometheus.MustNewConstMetric(c.heapBytes, prometheus.GaugeValue, float64(stats.PinnedBytes), "pinned")
+	ch <- prometheus.MustNewConstMetric(c.heapBytes, prometheus.GaugeValue, float64(stats.ReversibleBytes), "reversible")
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(stats.RecentEntryEvictions), "recent")
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(stats.AgeEvictions), "age")
+
+	ch <- prometheus.MustNewConstMetric(c.deleteFailures, prometheus.CounterValue, float64(stats.DeleteFailures))
+	ch <- prometheus.MustNewConstMetric(c.corruptions, prometheus.CounterValue, float64(stats.Corruptions))
+	ch <- prometheus.MustNewConstMetric(c.expirations, prometheus.CounterValue, float64(stats.Expirations))
+	ch <- prometheus.MustNewConstMetric(c.rejections, prometheus.CounterValue, float64(stats.AdmissionRejections))
+	ch <- prometheus.MustNewConstMetric(c.reorgBlocks, prometheus.CounterValue, float64(stats.ReorgBlocks))
+	ch <- prometheus.MustNewConstMetric(c.reorgBytes, prometheus.CounterValue, float64(stats.ReorgBytes))
+
+	ch <- c.latencyHistogram(stats.ReadLatency, "read")
+	ch <- c.latencyHistogram(stats.WriteLatency, "write")
+	ch <- c.latencyHistogram(stats.DeleteLatency, "delete")
+}
+
+func (c *Collector) latencyHistogram(latency atm.LatencyStats, operation string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(latency.Buckets))
+	for _, bucket := range latency.Buckets {
+		buckets[bucket.UpperBound.Seconds()] = bucket.Count
+	}
+
+	return prometheus.MustNewConstHistogram(c.ioLatency, latency.Count, latency.Sum.Seconds(), buckets, operation)
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streamingfast/atm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	cache := atm.NewCache(t.TempDir(), 1024, 1024, atm.NewFileIO())
+
+	_, err := cache.Write("key.0", time.Now(), time.Now(), []byte("data"))
+	require.NoError(t, err)
+	_, _, err = cache.Read("key.0")
+	require.NoError(t, err)
+	_, _, err = cache.Read("unknown")
+	require.NoError(t, err)
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(NewCollector(cache, "atm", prometheus.Labels{"deployment": "test"})))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	byName := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			switch {
+			case metric.Counter != nil:
+				byName[family.GetName()] += metric.Counter.GetValue()
+			case metric.Histogram != nil:
+				byName[family.GetName()] += float64(metric.Histogram.GetSampleCount())
+			}
+		}
+	}
+
+	require.Equal(t, float64(1), byName["atm_cache_hits_total"])
+	require.Equal(t, float64(1), byName["atm_cache_misses_total"])
+	require.Equal(t, float64(2), byName["atm_cache_io_latency_seconds"])
+}
@@ -0,0 +1,153 @@
+package objectstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FakeServer is a minimal S3 compatible server storing objects as files
+// under `<dir>/<bucket>/<key>`. It supports the operations used by IO, to
+// test caches backed by an object store without one, typically through
+// net/http/httptest.
+type FakeServer struct {
+	dir string
+
+	credentials *Credentials
+	region      string
+}
+
+func NewFakeServer(dir string) *FakeServer {
+	return &FakeServer{dir: dir}
+}
+
+// RequireSignature makes the server reject requests that are not signed
+// with credentials for region.
+func (s *FakeServer) RequireSignature(credentials Credentials, region string) {
+	s.credentials = &credentials
+	s.region = region
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(errorResponse{Code: code, Message: message})
+}
+
+func (s *FakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.credentials != nil && !s.validSignature(r) {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match")
+		return
+	}
+
+	objectPath := path.Clean("/" + r.URL.Path)
+	if strings.Count(objectPath, "/") < 2 {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "bucket and key are required")
+		return
+	}
+	filePath := filepath.Join(s.dir, filepath.FromSlash(objectPath))
+
+	switch r.Method {
+	case http.MethodPut:
+		s.put(w, r, filePath)
+	case http.MethodGet:
+		file, err := os.Open(filePath)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+			return
+		}
+		defer file.Close()
+
+		io.Copy(w, file)
+	case http.MethodDelete:
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not supported")
+	}
+}
+
+func (s *FakeServer) put(w http.ResponseWriter, r *http.Request, filePath string) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filePath), ".upload-")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	defer os.Remove(file.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), r.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	expected := r.Header.Get("X-Amz-Content-Sha256")
+	if expected != "" && expected != unsignedPayload && expected != hex.EncodeToString(hash.Sum(nil)) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the provided content hash does not match the payload")
+		return
+	}
+
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// validSignature signs a copy of r, holding only the headers r claims to
+// have signed, and compares the resulting authorization.
+func (s *FakeServer) validSignature(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, signingScheme+" Credential="+s.credentials.AccessKeyID+"/") {
+		return false
+	}
+
+	now, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+
+	check := &http.Request{
+		Method: r.Method,
+		URL:    &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Host:   r.Host,
+		Header: http.Header{},
+	}
+	for _, name := range signedHeaderNames(authorization) {
+		if name != "host" {
+			check.Header[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+		}
+	}
+
+	sign(check, *s.credentials, s.region, r.Header.Get("X-Amz-Content-Sha256"), now)
+	return check.Header.Get("Authorization") == authorization
+}
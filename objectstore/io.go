@@ -0,0 +1,236 @@
+// Package objectstore implements an atm.CacheIO storing cache items in an S3
+// compatible object store, the cache keeping track of capacity while the bytes
+// live remotely.
+package objectstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/streamingfast/atm"
+)
+
+// Config describes the bucket holding the cache items. Objects are addressed
+// path style, as `<Endpoint>/<Bucket>/<Prefix>/<cache path>`.
+type Config struct {
+	// Endpoint is the base URL of the object store, e.g.
+	// https://s3.us-east-1.amazonaws.com or http://localhost:9000.
+	Endpoint string
+	Bucket   string
+	Prefix   string
+
+	// Region is used to sign requests, us-east-1 when empty.
+	Region string
+	// Credentials sign every request, requests are anonymous when
+	// Credentials.AccessKeyID is empty.
+	Credentials Credentials
+
+	// HTTPClient sends the requests, http.DefaultClient when nil. Set its
+	// Timeout to bound the duration of cache IO operations.
+	HTTPClient *http.Client
+	// SpoolDir holds the temporary files WriteFrom buffers streams into, the
+	// object store needing to know the size of an object before receiving it.
+	// os.TempDir() when empty.
+	SpoolDir string
+}
+
+// IO is an atm.CacheIO storing every cache path as an object. Caches backed
+// by an IO are created with atm.NewCache, atm.NewInitializedCache only
+// rebuilding its index from a local directory.
+type IO struct {
+	config   Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+var _ atm.CacheIO = (*IO)(nil)
+
+func NewIO(config Config) (*IO, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", config.Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q, scheme and host are required", config.Endpoint)
+	}
+
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.SpoolDir == "" {
+		config.SpoolDir = os.TempDir()
+	}
+
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &IO{config: config, endpoint: endpoint, client: client, now: time.Now}, nil
+}
+
+func (o *IO) Write(path string, data []byte) error {
+	_, err := o.put(path, bytes.NewReader(data), int64(len(data)), hashHex(data))
+	return err
+}
+
+// WriteFrom spools reader to a temporary file, hashing it along the way, then
+// uploads the file.
+func (o *IO) WriteFrom(path string, reader io.Reader) (int64, error) {
+	spool, err := ioutil.TempFile(o.config.SpoolDir, "atm-spool-")
+	if err != nil {
+		return 0, fmt.Errorf("creating spool file: %w", err)
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), reader)
+	if err != nil {
+		return 0, fmt.Errorf("spooling %s: %w", path, err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("rewinding spool file: %w", err)
+	}
+
+	return o.put(path, spool, size, hex.EncodeToString(hash.Sum(nil)))
+}
+
+func (o *IO) put(path string, body io.Reader, size int64, payloadHash string) (int64, error) {
+	req, err := o.newRequest(http.MethodPut, path, body, payloadHash)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+
+	resp, err := o.do(req, path)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return size, nil
+}
+
+func (o *IO) Read(path string) ([]byte, error) {
+	reader, err := o.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (o *IO) OpenReader(path string) (io.ReadCloser, error) {
+	req, err := o.newRequest(http.MethodGet, path, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := o.do(req, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (o *IO) Delete(path string) error {
+	req, err := o.newRequest(http.MethodDelete, path, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.do(req, path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// objectKey maps a cache path to the key of its object.
+func (o *IO) objectKey(filePath string) string {
+	return strings.TrimPrefix(path.Join(o.config.Prefix, path.Clean("/"+filePath)), "/")
+}
+
+func (o *IO) newRequest(method string, filePath string, body io.Reader, payloadHash string) (*http.Request, error) {
+	objectPath := path.Join("/", o.endpoint.Path, o.config.Bucket, o.objectKey(filePath))
+
+	target := *o.endpoint
+	target.Path = objectPath
+	target.RawPath = uriEncode(objectPath)
+
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	if o.config.Credentials.AccessKeyID != "" {
+		sign(req, o.config.Credentials, o.config.Region, payloadHash, o.now())
+	}
+
+	return req, nil
+}
+
+// do sends req, turning unsuccessful responses into errors. A missing object
+// results in an error matching os.ErrNotExist, like atm.FileIO.
+func (o *IO) do(req *http.Request, filePath string) (*http.Response, error) {
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, filePath, err)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: strings.ToLower(req.Method), Path: filePath, Err: os.ErrNotExist}
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: unexpected status %s: %s", req.Method, filePath, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// uriEncode escapes every byte of p but the unreserved ones and `/`, as
+// expected by the canonical request of Signature Version 4.
+func uriEncode(p string) string {
+	const upperHex = "0123456789ABCDEF"
+
+	var out strings.Builder
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			out.WriteByte(b)
+			continue
+		}
+
+		out.WriteByte('%')
+		out.WriteByte(upperHex[b>>4])
+		out.WriteByte(upperHex[b&0x0F])
+	}
+
+	return out.String()
+}
@@ -0,0 +1,120 @@
+package objectstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat   = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	signingService  = "s3"
+	signingScheme   = "AWS4-HMAC-SHA256"
+)
+
+var emptyPayloadHash = hashHex(nil)
+
+// Credentials authenticate requests with AWS Signature Version 4.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only needed with temporary credentials.
+	SessionToken string
+}
+
+// sign adds the Signature Version 4 authorization to req. Every header
+// already set on req is signed along with the host, payloadHash is the hex
+// encoded SHA-256 of the body or unsignedPayload.
+func sign(req *http.Request, credentials Credentials, region string, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	canonicalHeaders, signedHeaders := canonicalizeHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{amzDate[:8], region, signingService, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{signingScheme, amzDate, scope, hashHex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), amzDate[:8])
+	for _, part := range []string{region, signingService, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", signingScheme+" Credential="+credentials.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func canonicalizeHeaders(req *http.Request) (canonical string, signed string) {
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" {
+			continue
+		}
+
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, name := range names {
+		out.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	return out.String(), strings.Join(names, ";")
+}
+
+// signedHeaderNames returns the names of the headers signed by the
+// authorization of req.
+func signedHeaderNames(authorization string) []string {
+	index := strings.Index(authorization, "SignedHeaders=")
+	if index == -1 {
+		return nil
+	}
+
+	names := authorization[index+len("SignedHeaders="):]
+	if end := strings.Index(names, ","); end != -1 {
+		names = names[:end]
+	}
+
+	return strings.Split(names, ";")
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,95 @@
+package atm
+
+import "time"
+
+// Option configures optional behaviors of a Cache.
+type Option func(c *Cache)
+
+// WithManifestCheckpointInterval sets how often the cache index is
+// checkpointed to its manifest file in basePath, a zero interval disables
+// checkpointing. NewInitializedCache checkpoints every
+// DefaultManifestCheckpointInterval unless told otherwise.
+func WithManifestCheckpointInterval(interval time.Duration) Option {
+	return func(c *Cache) {
+		c.manifestCheckpointInterval = interval
+	}
+}
+
+// WithCodec sets the codec applied to the data of newly written items, it is
+// registered so items written with it can be decoded. Items are accounted
+// for their encoded size.
+func WithCodec(codec Codec) Option {
+	return func(c *Cache) {
+		RegisterCodec(codec)
+		c.codec = codec
+	}
+}
+
+// WithMemoryTier keeps the decoded data of recently read or written items in
+// memory, up to maxBytes, so repeated reads are served without any IO. Items
+// are dropped from memory as soon as they leave the cache. Streamed writes do
+// not populate the memory tier, only reads of the whole data do.
+func WithMemoryTier(maxBytes int) Option {
+	return func(c *Cache) {
+		c.memory = newMemoryTier(maxBytes)
+	}
+}
+
+// WithExpirationInterval sets how often items written with a TTL are checked
+// for expiration and removed, a zero interval disables the removal. Expired
+// items are reported as misses either way.
+func WithExpirationInterval(interval time.Duration) Option {
+	return func(c *Cache) {
+		c.expirationInterval = interval
+	}
+}
+
+// WithMaxPinnedBytes caps the bytes of the items pinned with Pin, so pinning
+// cannot starve the cache. Pinned items are not accounted in the recent entry
+// and age heap budgets. Pinning is unlimited by default.
+func WithMaxPinnedBytes(maxBytes int) Option {
+	return func(c *Cache) {
+		c.maxPinnedBytes = maxBytes
+	}
+}
+
+// WithAccessOrder orders the recent entry heap by last access instead of
+// insertion, reads moving items to the back of the eviction order so the
+// recent entry heap behaves as an LRU. Items are considered accessed at their
+// insertion date until read, reads being timestamped with the wall clock.
+func WithAccessOrder() Option {
+	return func(c *Cache) {
+		c.accessOrder = true
+	}
+}
+
+// WithEvictionPolicy replaces the default RecentAgePolicy, the heap budgets
+// given to the cache constructor are then unused.
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(c *Cache) {
+		c.policy = policy
+	}
+}
+
+// WithAdmissionFilter makes writes that would evict items go through a TinyLFU
+// admission filter: the new item is only admitted when it was looked up more
+// often than each of the items it would push out, so a scan over cold keys
+// cannot flush the hot ones. Lookups, hits and misses alike, are counted in a
+// count-min sketch sized for expectedItems keys and aging over time. Refused
+// writes fail with ErrNotAdmitted. The eviction policy must implement
+// VictimPeeker, the filter admits everything otherwise.
+func WithAdmissionFilter(expectedItems int) Option {
+	return func(c *Cache) {
+		c.admission = newCountMinSketch(expectedItems)
+	}
+}
+
+// WithReversibleTier keeps the items written with the Reversible option, up to
+// maxBytes, in a tier of their own evicting the oldest inserted ones. They are
+// moved to the age tier of the eviction policy by BlockCache.MarkIrreversible,
+// so blocks of abandoned forks never take room in long-term storage.
+func WithReversibleTier(maxBytes int) Option {
+	return func(c *Cache) {
+		c.reversible = NewHeap(ByInsertionTime, maxBytes)
+	}
+}
@@ -0,0 +1,80 @@
+package atm
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// ErrPinLimit is returned by Pin when pinning the item would go over the
+// pinned bytes budget set with WithMaxPinnedBytes.
+var ErrPinLimit = errors.New("pinned bytes limit reached")
+
+// Pin protects key from being evicted to make room for other items, until
+// Unpin is called. Pinned items are taken out of the eviction policy, their
+// bytes being accounted separately. They are still removed by Delete,
+// InvalidateKeys, block invalidation, expiration or when found corrupted.
+// Pinning is not persisted across restarts. It returns false when key is not
+// cached.
+func (c *Cache) Pin(key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false, ErrClosed
+	}
+
+	cacheItem, found := c.index[key]
+	if !found || cacheItem.expired(c.now()) {
+		return false, nil
+	}
+	if cacheItem.pinned {
+		return true, nil
+	}
+
+	if c.maxPinnedBytes > 0 && c.pinnedBytes+cacheItem.size > c.maxPinnedBytes {
+		return false, fmt.Errorf("pinning %q of %d bytes with %d bytes pinned: %w", key, cacheItem.size, c.pinnedBytes, ErrPinLimit)
+	}
+
+	c.untrackWithLock(cacheItem)
+	cacheItem.pinned = true
+	c.pinnedCount++
+	c.pinnedBytes += cacheItem.size
+
+	zlog.Debug("pinned cache item", zap.Stringer("item", cacheItem))
+	return true, nil
+}
+
+// Unpin makes key evictable again, handing it back to the eviction policy, or
+// to the reversible tier, as if it was just written. It returns false when key
+// is not pinned.
+func (c *Cache) Unpin(key string) (bool, error) {
+	defer c.dispatchEvents()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false, ErrClosed
+	}
+
+	cacheItem, found := c.index[key]
+	if !found || !cacheItem.pinned {
+		return false, nil
+	}
+
+	c.releasePinWithLock(cacheItem)
+	c.trackWithLock(cacheItem, cacheItem.size)
+
+	zlog.Debug("unpinned cache item", zap.Stringer("item", cacheItem))
+	return true, nil
+}
+
+// releasePinWithLock clears the pinned state of cacheItem, which is then not
+// tracked by the eviction policy.
+func (c *Cache) releasePinWithLock(cacheItem *CacheItem) { //this func should always be call within a cache lock
+	cacheItem.pinned = false
+	c.pinnedCount--
+	c.pinnedBytes -= cacheItem.size
+}
@@ -0,0 +1,71 @@
+package atm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_Pin(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	cache := NewCache("/cache", 10, 10, store, WithMaxPinnedBytes(10))
+	defer cache.Close(context.Background())
+
+	write := func(key string, offset int) {
+		t.Helper()
+		_, err := cache.Write(key, ttime(offset), ttime(offset), []byte("12345"))
+		require.NoError(t, err)
+	}
+
+	write("genesis", 0)
+	pinned, err := cache.Pin("genesis")
+	require.NoError(t, err)
+	require.True(t, pinned)
+	pinned, err = cache.Pin("genesis")
+	require.NoError(t, err)
+	require.True(t, pinned)
+
+	pinned, err = cache.Pin("unknown")
+	require.NoError(t, err)
+	require.False(t, pinned)
+
+	// Way more than both heaps can hold, the pinned item stays
+	for i := 1; i <= 10; i++ {
+		write(string(rune('a'+i)), i)
+		requireConsistent(t, cache, store)
+	}
+	require.Contains(t, cache.index, "genesis")
+	require.True(t, cache.index["genesis"].Pinned())
+
+	stats := cache.Stats()
+	require.Equal(t, 1, stats.PinnedCount)
+	require.Equal(t, 5, stats.PinnedBytes)
+	require.Equal(t, 10, stats.RecentEntryBytes)
+
+	// The pinned bytes budget is enforced
+	pinned, err = cache.Pin("k")
+	require.NoError(t, err)
+	require.True(t, pinned)
+	_, err = cache.Pin("j")
+	require.True(t, errors.Is(err, ErrPinLimit))
+	requireConsistent(t, cache, store)
+
+	// Unpinned items get back in the recent entry heap, making room for themselves
+	unpinned, err := cache.Unpin("genesis")
+	require.NoError(t, err)
+	require.True(t, unpinned)
+	unpinned, err = cache.Unpin("genesis")
+	require.NoError(t, err)
+	require.False(t, unpinned)
+	requireConsistent(t, cache, store)
+	require.True(t, recentAge(cache).recentEntryHeap.Contains("genesis"))
+
+	// Deleting a pinned item releases its pinned bytes
+	_, err = cache.Delete("k")
+	require.NoError(t, err)
+	requireConsistent(t, cache, store)
+	require.Equal(t, 0, cache.Stats().PinnedBytes)
+}
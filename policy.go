@@ -0,0 +1,202 @@
+package atm
+
+import (
+	"container/heap"
+
+	"go.uber.org/zap"
+)
+
+// EvictionPolicy decides which items leave the cache to make room for new
+// ones. Its methods are called under the cache lock, so never concurrently,
+// and must not call back into the cache.
+type EvictionPolicy interface {
+	// OnInsert is called when item is added to the cache, once Victims made
+	// room for it.
+	OnInsert(item *CacheItem)
+	// OnAccess is called when item is written again or, when the policy tracks
+	// accesses, read.
+	OnAccess(item *CacheItem)
+	// OnRemove is called when item leaves the cache without being chosen by
+	// Victims, because it was deleted, expired, corrupted or pinned.
+	OnRemove(item *CacheItem)
+	// Victims returns the items to evict so that neededBytes more bytes fit in
+	// the cache. Evicted items must not be tracked by the policy anymore.
+	Victims(neededBytes int) []Eviction
+}
+
+// Eviction is an item chosen by an EvictionPolicy to make room.
+type Eviction struct {
+	Item *CacheItem
+	// Reason is reported to the evict, or promote, listeners.
+	Reason EventReason
+	// Promoted is set when the item stays cached, moved to another tier of
+	// the policy.
+	Promoted bool
+}
+
+// accessIgnorer is implemented by policies that can tell the cache not to
+// report reads, sparing the exclusive lock taken for each OnAccess.
+type accessIgnorer interface {
+	ignoresAccess() bool
+}
+
+// tieredPolicy is implemented by policies organizing items in named tiers,
+// which are saved in the manifest so restored items go back to their tier.
+type tieredPolicy interface {
+	tierOf(item *CacheItem) string
+	restore(item *CacheItem, tier string)
+	// trim evicts the items going over budget after a restore, budgets might
+	// have been lowered since the checkpoint.
+	trim() []Eviction
+}
+
+// RecentAgePolicy is the default EvictionPolicy. New items enter a recent
+// entry heap, ordered by insertion or last access, and are moved once evicted
+// from it to an age heap ordered by item date, which holds the most recent
+// items of the data set. Items older than all the items of a full age heap are
+// dropped.
+type RecentAgePolicy struct {
+	recentEntryHeap *Heap
+	ageHeap         *Heap
+
+	accessOrder bool
+
+	// Guarded by the cache lock, like every policy method
+	recentEntryEvictions uint64
+	ageEvictions         uint64
+}
+
+func NewRecentAgePolicy(maxRecentEntryBytes, maxEntryByAgeBytes int) *RecentAgePolicy {
+	p := &RecentAgePolicy{
+		recentEntryHeap: NewHeap(ByInsertionTime, maxRecentEntryBytes),
+		ageHeap:         NewHeap(ByAge, maxEntryByAgeBytes),
+	}
+
+	heap.Init(p.ageHeap)
+	heap.Init(p.recentEntryHeap)
+
+	return p
+}
+
+// orderByAccess orders the recent entry heap by last access, it must be
+// called before any item is inserted.
+func (p *RecentAgePolicy) orderByAccess() {
+	p.accessOrder = true
+	p.recentEntryHeap.less = ByLastAccess
+}
+
+func (p *RecentAgePolicy) ignoresAccess() bool {
+	return !p.accessOrder
+}
+
+func (p *RecentAgePolicy) OnInsert(item *CacheItem) {
+	heap.Push(p.recentEntryHeap, item)
+}
+
+func (p *RecentAgePolicy) OnAccess(item *CacheItem) {
+	p.recentEntryHeap.Fix(item.key)
+}
+
+func (p *RecentAgePolicy) OnRemove(item *CacheItem) {
+	p.recentEntryHeap.Remove(item.key)
+	p.ageHeap.Remove(item.key)
+}
+
+// Victims frees neededBytes in the recent entry heap, moving the evicted items
+// to the age heap when they fit, or when they are more recent than the oldest
+// items of the age heap, dropping them otherwise.
+func (p *RecentAgePolicy) Victims(neededBytes int) []Eviction {
+	evictions, _ := p.victims(neededBytes)
+	return evictions
+}
+
+// victims implements Victims, also returning the items taken out of the
+// recent entry heap.
+func (p *RecentAgePolicy) victims(neededBytes int) (evictions []Eviction, evictedCacheItems []*CacheItem) {
+	evictedCacheItems = purge(p.recentEntryHeap, neededBytes)
+	p.recentEntryEvictions += uint64(len(evictedCacheItems))
+	if len(evictedCacheItems) > 0 {
+		zlog.Debug("evicted from recent entry heap", zap.Reflect("items", evictedCacheItems))
+	}
+
+	for _, evicted := range evictedCacheItems {
+		if p.ageHeap.FreeSpace() >= evicted.size { //we need space
+			heap.Push(p.ageHeap, evicted)
+			evictions = append(evictions, Eviction{Item: evicted, Reason: ReasonCapacity, Promoted: true})
+			continue
+		}
+
+		peek := p.ageHeap.Peek()
+		if peek != nil && peek.itemDate.Before(evicted.itemDate) { //evicted item is older then last age item so we remove it
+			evictedAgeItems := purge(p.ageHeap, neededBytes)
+			p.ageEvictions += uint64(len(evictedAgeItems))
+			for _, ageEvicted := range evictedAgeItems {
+				evictions = append(evictions, Eviction{Item: ageEvicted, Reason: ReasonCapacity})
+			}
+			heap.Push(p.ageHeap, evicted)
+			evictions = append(evictions, Eviction{Item: evicted, Reason: ReasonCapacity, Promoted: true})
+		} else {
+			evictions = append(evictions, Eviction{Item: evicted, Reason: ReasonTooOld})
+		}
+	}
+
+	return evictions, evictedCacheItems
+}
+
+func (p *RecentAgePolicy) tierOf(item *CacheItem) string {
+	if p.ageHeap.Contains(item.key) {
+		return heapAge
+	}
+	return heapRecent
+}
+
+func (p *RecentAgePolicy) restore(item *CacheItem, tier string) {
+	if tier == heapAge {
+		heap.Push(p.ageHeap, item)
+		return
+	}
+	heap.Push(p.recentEntryHeap, item)
+}
+
+func (p *RecentAgePolicy) trim() (evictions []Eviction) {
+	for _, evicted := range purge(p.recentEntryHeap, 0) {
+		if p.ageHeap.FreeSpace() >= evicted.size {
+			heap.Push(p.ageHeap, evicted)
+			continue
+		}
+		evictions = append(evictions, Eviction{Item: evicted, Reason: ReasonCapacity})
+	}
+	for _, evicted := range purge(p.ageHeap, 0) {
+		evictions = append(evictions, Eviction{Item: evicted, Reason: ReasonCapacity})
+	}
+
+	return evictions
+}
+
+// purge pops items out of h until it has neededSpace bytes available, or is
+// empty.
+func purge(h *Heap, neededSpace int) (evictedCacheItems []*CacheItem) {
+	for h.FreeSpace() < neededSpace {
+		removed := heap.Pop(h)
+		if removed == nil {
+			return
+		}
+
+		evictedCacheItems = append(evictedCacheItems, removed.(*CacheItem))
+	}
+
+	return
+}
+
+// applyEvictionsWithLock reports the decisions of the eviction policy, dropping
+// the evicted items from the cache.
+func (c *Cache) applyEvictionsWithLock(evictions []Eviction) { //this func should always be call within a cache lock
+	for _, eviction := range evictions {
+		if eviction.Promoted {
+			c.emitWithLock(eventPromote, eviction.Item, eviction.Reason)
+			continue
+		}
+
+		c.dropWithLock(eviction.Item, eviction.Reason)
+	}
+}
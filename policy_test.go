@@ -0,0 +1,109 @@
+package atm
+
+import (
+	"container/list"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func recentAge(cache *Cache) *RecentAgePolicy {
+	return cache.policy.(*RecentAgePolicy)
+}
+
+// lruPolicy is a single tier least recently used policy, tracking calls made
+// by the cache.
+type lruPolicy struct {
+	maxBytes int
+	size     int
+	items    *list.List
+	elements map[string]*list.Element
+
+	accesses []string
+	removals []string
+}
+
+func newLRUPolicy(maxBytes int) *lruPolicy {
+	return &lruPolicy{maxBytes: maxBytes, items: list.New(), elements: map[string]*list.Element{}}
+}
+
+func (p *lruPolicy) OnInsert(item *CacheItem) {
+	p.elements[item.key] = p.items.PushFront(item)
+	p.size += item.size
+}
+
+func (p *lruPolicy) OnAccess(item *CacheItem) {
+	p.accesses = append(p.accesses, item.key)
+	p.items.MoveToFront(p.elements[item.key])
+}
+
+func (p *lruPolicy) OnRemove(item *CacheItem) {
+	p.removals = append(p.removals, item.key)
+	p.remove(item)
+}
+
+func (p *lruPolicy) remove(item *CacheItem) {
+	p.items.Remove(p.elements[item.key])
+	delete(p.elements, item.key)
+	p.size -= item.size
+}
+
+func (p *lruPolicy) Victims(neededBytes int) (evictions []Eviction) {
+	for p.size+neededBytes > p.maxBytes && p.items.Len() > 0 {
+		item := p.items.Back().Value.(*CacheItem)
+		p.remove(item)
+		evictions = append(evictions, Eviction{Item: item, Reason: ReasonCapacity})
+	}
+
+	return evictions
+}
+
+func TestCache_EvictionPolicy(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	policy := newLRUPolicy(15)
+	cache := NewCache("/cache", 0, 0, store, WithEvictionPolicy(policy))
+	events := recordEvents(cache)
+
+	for i, key := range []string{"a", "b", "c"} {
+		_, err := cache.Write(key, ttime(i), ttime(i), []byte("12345"))
+		require.NoError(t, err)
+	}
+
+	// Reads are reported to custom policies, a is now the most recently used
+	_, found, err := cache.Read("a")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []string{"a"}, policy.accesses)
+
+	_, err = cache.Write("d", ttime(3), ttime(3), []byte("12345"))
+	require.NoError(t, err)
+	require.NotContains(t, cache.index, "b")
+
+	_, err = cache.Delete("c")
+	require.NoError(t, err)
+	_, err = cache.Pin("d")
+	require.NoError(t, err)
+	require.Equal(t, []string{"c", "d"}, policy.removals)
+	requireConsistent(t, cache, store)
+
+	stats := cache.Stats()
+	require.Equal(t, 2, stats.ItemCount)
+	require.Equal(t, 0, stats.RecentEntryCount)
+
+	require.NoError(t, cache.Close(context.Background()))
+	require.Equal(t, []string{"b:capacity", "c:explicit"}, events.get("evict"))
+	require.Equal(t, 2, store.Len())
+}
+
+func TestRecentAgePolicy_IgnoresAccess(t *testing.T) {
+	cache := NewCache("/cache", 10, 10, NewMemoryIO())
+	defer cache.Close(context.Background())
+	require.False(t, cache.trackAccess)
+
+	ordered := NewCache("/cache", 10, 10, NewMemoryIO(), WithEvictionPolicy(NewRecentAgePolicy(10, 10)), WithAccessOrder())
+	defer ordered.Close(context.Background())
+	require.True(t, ordered.trackAccess)
+	require.True(t, recentAge(ordered).accessOrder)
+}
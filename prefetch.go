@@ -0,0 +1,377 @@
+package atm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultPrefetchDepth       = 8
+	DefaultPrefetchConcurrency = 4
+	DefaultPrefetchIdleTimeout = 30 * time.Second
+)
+
+// prefetchStreams bounds how many concurrent sequential scans are followed
+const prefetchStreams = 16
+
+// BlockLoader fetches the canonical block numbered num from its source of
+// truth, along with the item date it is cached with.
+type BlockLoader func(ctx context.Context, num uint64) (block Block, itemDate time.Time, err error)
+
+// PrefetchOption configures a Prefetcher.
+type PrefetchOption func(p *Prefetcher)
+
+// WithPrefetchDepth sets how many blocks are loaded ahead of a sequential
+// scan, DefaultPrefetchDepth by default.
+func WithPrefetchDepth(depth int) PrefetchOption {
+	return func(p *Prefetcher) {
+		p.depth = depth
+	}
+}
+
+// WithPrefetchConcurrency sets how many blocks are prefetched at once,
+// DefaultPrefetchConcurrency by default.
+func WithPrefetchConcurrency(concurrency int) PrefetchOption {
+	return func(p *Prefetcher) {
+		p.concurrency = concurrency
+	}
+}
+
+// WithPrefetchIdleTimeout sets after how long without reads a scan is
+// considered abandoned, releasing the budget held by the blocks prefetched for
+// it, DefaultPrefetchIdleTimeout by default.
+func WithPrefetchIdleTimeout(timeout time.Duration) PrefetchOption {
+	return func(p *Prefetcher) {
+		p.idleTimeout = timeout
+	}
+}
+
+// PrefetchStats is a point in time snapshot of the prefetcher counters.
+type PrefetchStats struct {
+	// Prefetched counts the blocks written to the cache ahead of their read.
+	Prefetched uint64
+	// Hits counts the reads served by a prefetched block.
+	Hits uint64
+	// OverBudget counts the prefetched blocks not written to the cache
+	// because the prefetch byte budget was used up.
+	OverBudget uint64
+	// PendingBytes is the data size of the prefetched blocks not read yet.
+	PendingBytes int
+}
+
+// Prefetcher serves blocks by number from a BlockCache, loading misses through
+// its loader. When reads follow each other block after block, the next blocks
+// are loaded in the background so the scan finds them cached. Prefetched
+// blocks not read yet hold at most maxBytes of data, so prefetching takes at
+// most that much room from the working set of the cache. The budget held for a
+// scan is released once it is abandoned.
+type Prefetcher struct {
+	blocks *BlockCache
+	loader BlockLoader
+
+	depth       int
+	concurrency int
+	maxBytes    int
+	idleTimeout time.Duration
+	slots       chan struct{}
+
+	mu sync.Mutex
+	// expected holds each followed scan by its next block number
+	expected     map[uint64]*prefetchStream
+	inflight     map[uint64]*prefetchCall
+	pending      map[BlockKey]pendingBlock
+	pendingBytes int
+
+	prefetched uint64
+	hits       uint64
+	overBudget uint64
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	running     sync.WaitGroup
+	unsubscribe Unsubscribe
+}
+
+type prefetchCall struct {
+	done  chan struct{}
+	block Block
+	err   error
+}
+
+// prefetchStream is a followed scan, the blocks prefetched for it hold budget
+// until read, evicted or the scan is abandoned.
+type prefetchStream struct {
+	lastRead  time.Time
+	abandoned bool
+}
+
+type pendingBlock struct {
+	size   int
+	stream *prefetchStream
+}
+
+// NewPrefetcher creates a Prefetcher loading blocks with loader into blocks,
+// maxBytes bounding the data of the prefetched blocks not read yet.
+func NewPrefetcher(blocks *BlockCache, loader BlockLoader, maxBytes int, opts ...PrefetchOption) *Prefetcher {
+	p := &Prefetcher{
+		blocks:      blocks,
+		loader:      loader,
+		depth:       DefaultPrefetchDepth,
+		concurrency: DefaultPrefetchConcurrency,
+		maxBytes:    maxBytes,
+		idleTimeout: DefaultPrefetchIdleTimeout,
+		expected:    map[uint64]*prefetchStream{},
+		inflight:    map[uint64]*prefetchCall{},
+		pending:     map[BlockKey]pendingBlock{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.slots = make(chan struct{}, p.concurrency)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	p.unsubscribe = blocks.Cache().OnEvict(func(item *CacheItem, _ EventReason) {
+		if key, err := ParseBlockKey(item.Key()); err == nil {
+			p.consumed(key)
+		}
+	})
+
+	return p
+}
+
+// Get returns the block numbered num, from the cache when a single block of
+// that number is cached, from the loader otherwise. Loaded blocks are written
+// to the cache. Concurrent loads of the same number, prefetches included, are
+// collapsed into a single loader call. The shared load runs in the background
+// without the cancellation of ctx, every Get stops waiting when its own ctx is
+// done.
+func (p *Prefetcher) Get(ctx context.Context, num uint64) (Block, error) {
+	p.observe(num)
+
+	if keys := p.blocks.Keys(num, num); len(keys) == 1 {
+		data, found, err := p.blocks.Read(keys[0])
+		if err == nil && found {
+			if p.consumed(keys[0]) {
+				atomic.AddUint64(&p.hits, 1)
+			}
+			return Block{Key: keys[0], Data: data}, nil
+		}
+	}
+
+	p.mu.Lock()
+	call, found := p.inflight[num]
+	if !found {
+		call = p.startLoadWithLock(num)
+	}
+	p.mu.Unlock()
+
+	if !found {
+		go p.load(detachedContext{parent: ctx}, num, call, nil)
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return Block{}, ctx.Err()
+	}
+	if call.err != nil {
+		return Block{}, call.err
+	}
+
+	if p.consumed(call.block.Key) {
+		atomic.AddUint64(&p.hits, 1)
+	}
+	return call.block, nil
+}
+
+// observe follows the scan num belongs to, prefetching the next blocks when
+// num continues it. Scans left idle, or dropped to follow newer ones, are
+// abandoned.
+func (p *Prefetcher) observe(num uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for next, stream := range p.expected {
+		if next != num && now.Sub(stream.lastRead) >= p.idleTimeout {
+			p.abandonWithLock(next)
+		}
+	}
+
+	stream, sequential := p.expected[num]
+	delete(p.expected, num)
+	if !sequential {
+		stream = &prefetchStream{}
+	}
+	if len(p.expected) >= prefetchStreams {
+		for next := range p.expected {
+			p.abandonWithLock(next)
+			break
+		}
+	}
+	stream.lastRead = now
+	p.expected[num+1] = stream
+
+	if !sequential || p.ctx.Err() != nil {
+		return
+	}
+
+	for next := num + 1; next <= num+uint64(p.depth) && next > num; next++ {
+		if p.pendingBytes >= p.maxBytes {
+			return
+		}
+		if _, found := p.inflight[next]; found || len(p.blocks.Keys(next, next)) > 0 {
+			continue
+		}
+
+		call := p.startLoadWithLock(next)
+		p.running.Add(1)
+		go func(next uint64) {
+			defer p.running.Done()
+			p.load(p.ctx, next, call, stream)
+		}(next)
+	}
+}
+
+// abandonWithLock stops following the scan expecting next, releasing the
+// budget held by the blocks prefetched for it.
+func (p *Prefetcher) abandonWithLock(next uint64) {
+	stream := p.expected[next]
+	delete(p.expected, next)
+	stream.abandoned = true
+
+	for key, pending := range p.pending {
+		if pending.stream == stream {
+			delete(p.pending, key)
+			p.pendingBytes -= pending.size
+		}
+	}
+}
+
+func (p *Prefetcher) startLoadWithLock(num uint64) *prefetchCall {
+	call := &prefetchCall{done: make(chan struct{})}
+	p.inflight[num] = call
+	return call
+}
+
+// load runs the loader for num, writing the block to the cache. Prefetches,
+// made for stream, run within the concurrency limit and are only written when
+// they fit in the byte budget. A panicking loader fails the load, waiters are
+// still released.
+func (p *Prefetcher) load(ctx context.Context, num uint64, call *prefetchCall, stream *prefetchStream) {
+	prefetch := stream != nil
+	defer func() {
+		if r := recover(); r != nil {
+			zlog.Error("block loader panicked", zap.Uint64("num", num), zap.Any("panic", r))
+			call.block, call.err = Block{}, fmt.Errorf("loading block %d: loader panicked: %v", num, r)
+		}
+
+		p.mu.Lock()
+		delete(p.inflight, num)
+		p.mu.Unlock()
+		close(call.done)
+	}()
+
+	if prefetch {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			call.err = ctx.Err()
+			return
+		}
+		defer func() { <-p.slots }()
+	}
+
+	block, itemDate, err := p.loader(ctx, num)
+	if err != nil {
+		call.err = fmt.Errorf("loading block %d: %w", num, err)
+		if prefetch {
+			zlog.Debug("failed to prefetch block", zap.Uint64("num", num), zap.Error(err))
+		}
+		return
+	}
+	call.block = block
+
+	if prefetch && !p.reserve(block, stream) {
+		return
+	}
+
+	if _, err := p.blocks.Write(block.Key, itemDate, time.Now(), block.Data); err != nil {
+		if prefetch {
+			p.consumed(block.Key)
+		}
+		zlog.Warn("failed to write loaded block to cache", zap.Stringer("key", block.Key), zap.Error(err))
+		return
+	}
+	if prefetch {
+		atomic.AddUint64(&p.prefetched, 1)
+	}
+}
+
+// reserve accounts the data of a block prefetched for stream not read yet, it
+// returns false when the scan was abandoned meanwhile or when the block does
+// not fit in the budget.
+func (p *Prefetcher) reserve(block Block, stream *prefetchStream) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, found := p.pending[block.Key]; found {
+		return true
+	}
+	if stream.abandoned {
+		return false
+	}
+	if p.pendingBytes+len(block.Data) > p.maxBytes {
+		atomic.AddUint64(&p.overBudget, 1)
+		return false
+	}
+
+	p.pending[block.Key] = pendingBlock{size: len(block.Data), stream: stream}
+	p.pendingBytes += len(block.Data)
+	return true
+}
+
+// consumed releases the budget held by the prefetched block key, once read
+// or evicted. It returns false when key was not a pending prefetched block.
+func (p *Prefetcher) consumed(key BlockKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending, found := p.pending[key]
+	if !found {
+		return false
+	}
+
+	delete(p.pending, key)
+	p.pendingBytes -= pending.size
+	return true
+}
+
+// Stats returns a snapshot of the prefetcher counters.
+func (p *Prefetcher) Stats() PrefetchStats {
+	p.mu.Lock()
+	pendingBytes := p.pendingBytes
+	p.mu.Unlock()
+
+	return PrefetchStats{
+		Prefetched:   atomic.LoadUint64(&p.prefetched),
+		Hits:         atomic.LoadUint64(&p.hits),
+		OverBudget:   atomic.LoadUint64(&p.overBudget),
+		PendingBytes: pendingBytes,
+	}
+}
+
+// Close cancels the running prefetches and waits for them to return, Get
+// keeps serving blocks without prefetching afterward. The prefetcher stops
+// listening to the cache evictions.
+func (p *Prefetcher) Close() {
+	p.unsubscribe()
+	p.cancel()
+	p.running.Wait()
+}
@@ -0,0 +1,237 @@
+package atm
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testBlockLoader struct {
+	mu        sync.Mutex
+	calls     map[uint64]int
+	active    int
+	maxActive int
+	delay     time.Duration
+}
+
+func (l *testBlockLoader) load(ctx context.Context, num uint64) (Block, time.Time, error) {
+	l.mu.Lock()
+	if l.calls == nil {
+		l.calls = map[uint64]int{}
+	}
+	l.calls[num]++
+	l.active++
+	if l.active > l.maxActive {
+		l.maxActive = l.active
+	}
+	l.mu.Unlock()
+
+	time.Sleep(l.delay)
+
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+
+	return Block{Key: BlockKey{Num: num, ID: "id"}, Data: []byte("0123456789")}, ttime(int(num)), nil
+}
+
+func (l *testBlockLoader) callsOf(num uint64) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.calls[num]
+}
+
+func newPrefetchTestCache(t *testing.T) *BlockCache {
+	t.Helper()
+	SystemBlockSize = 0
+	cache := NewCache("/cache", 10_000, 10_000, NewMemoryIO())
+	t.Cleanup(func() { cache.Close(context.Background()) })
+
+	return NewBlockCache(cache)
+}
+
+func TestPrefetcher_SequentialScan(t *testing.T) {
+	blocks := newPrefetchTestCache(t)
+	loader := &testBlockLoader{}
+	prefetcher := NewPrefetcher(blocks, loader.load, 1000, WithPrefetchDepth(3))
+	defer prefetcher.Close()
+
+	ctx := context.Background()
+	block, err := prefetcher.Get(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, BlockKey{1, "id"}, block.Key)
+	require.Equal(t, []byte("0123456789"), block.Data)
+	require.Len(t, blocks.Keys(2, 100), 0)
+
+	_, err = prefetcher.Get(ctx, 2)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(blocks.Keys(3, 5)) == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, 30, prefetcher.Stats().PendingBytes)
+
+	block, err = prefetcher.Get(ctx, 3)
+	require.NoError(t, err)
+	require.Equal(t, BlockKey{3, "id"}, block.Key)
+	require.Eventually(t, func() bool { return len(blocks.Keys(6, 6)) == 1 }, time.Second, time.Millisecond)
+
+	for num := uint64(1); num <= 6; num++ {
+		require.Equal(t, 1, loader.callsOf(num), "loads of %d", num)
+	}
+
+	stats := prefetcher.Stats()
+	require.Equal(t, uint64(4), stats.Prefetched)
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, 30, stats.PendingBytes)
+
+	// Evicted prefetched blocks release their budget
+	_, _, err = blocks.InvalidateAbove(4)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return prefetcher.Stats().PendingBytes == 10 }, time.Second, time.Millisecond)
+}
+
+func TestPrefetcher_RandomReads(t *testing.T) {
+	blocks := newPrefetchTestCache(t)
+	loader := &testBlockLoader{}
+	prefetcher := NewPrefetcher(blocks, loader.load, 1000)
+
+	for _, num := range []uint64{10, 5, 20, 7} {
+		_, err := prefetcher.Get(context.Background(), num)
+		require.NoError(t, err)
+	}
+	prefetcher.Close()
+
+	require.Len(t, blocks.Keys(0, 100), 4)
+	require.Equal(t, uint64(0), prefetcher.Stats().Prefetched)
+}
+
+func TestPrefetcher_Budget(t *testing.T) {
+	blocks := newPrefetchTestCache(t)
+	loader := &testBlockLoader{delay: 5 * time.Millisecond}
+	prefetcher := NewPrefetcher(blocks, loader.load, 25, WithPrefetchDepth(6), WithPrefetchConcurrency(2))
+
+	// Block 2 is cached so that only prefetches run once the scan is detected
+	_, err := blocks.Write(BlockKey{2, "id"}, ttime(2), ttime(2), []byte("0123456789"))
+	require.NoError(t, err)
+	for num := uint64(1); num <= 2; num++ {
+		_, err := prefetcher.Get(context.Background(), num)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		stats := prefetcher.Stats()
+		return stats.Prefetched+stats.OverBudget == 6
+	}, time.Second, time.Millisecond)
+	prefetcher.Close()
+
+	stats := prefetcher.Stats()
+	require.Equal(t, uint64(2), stats.Prefetched)
+	require.Equal(t, uint64(4), stats.OverBudget)
+	require.Equal(t, 20, stats.PendingBytes)
+	require.Len(t, blocks.Keys(3, 100), 2)
+	require.LessOrEqual(t, loader.maxActive, 2)
+}
+
+func TestPrefetcher_FirstCallerCanceled(t *testing.T) {
+	blocks := newPrefetchTestCache(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loader := func(ctx context.Context, num uint64) (Block, time.Time, error) {
+		close(started)
+		<-release
+		return Block{Key: BlockKey{Num: num, ID: "id"}, Data: []byte("0123456789")}, ttime(int(num)), ctx.Err()
+	}
+	prefetcher := NewPrefetcher(blocks, loader, 1000)
+	defer prefetcher.Close()
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		_, err := prefetcher.Get(firstCtx, 1)
+		firstDone <- err
+	}()
+	<-started
+
+	waiterDone := make(chan Block)
+	go func() {
+		block, err := prefetcher.Get(context.Background(), 1)
+		assert.NoError(t, err)
+		waiterDone <- block
+	}()
+
+	// The caller which started the load stops waiting, the load goes on for
+	// the other callers
+	cancelFirst()
+	require.Equal(t, context.Canceled, <-firstDone)
+	close(release)
+	require.Equal(t, BlockKey{1, "id"}, (<-waiterDone).Key)
+	require.Len(t, blocks.Keys(1, 1), 1)
+}
+
+func TestPrefetcher_CloseStopsListening(t *testing.T) {
+	blocks := newPrefetchTestCache(t)
+	loader := &testBlockLoader{}
+	prefetcher := NewPrefetcher(blocks, loader.load, 1000)
+	prefetcher.Close()
+
+	blocks.Cache().listenersMu.RLock()
+	defer blocks.Cache().listenersMu.RUnlock()
+	require.Len(t, blocks.Cache().listeners[eventEvict], 0)
+}
+
+func TestPrefetcher_LoaderPanic(t *testing.T) {
+	blocks := newPrefetchTestCache(t)
+
+	var startOnce sync.Once
+	started := make(chan struct{})
+	release := make(chan struct{})
+	prefetcher := NewPrefetcher(blocks, func(ctx context.Context, num uint64) (Block, time.Time, error) {
+		startOnce.Do(func() { close(started) })
+		<-release
+		panic("boom")
+	}, 1000)
+	defer prefetcher.Close()
+
+	firstDone := make(chan error)
+	go func() {
+		_, err := prefetcher.Get(context.Background(), 1)
+		firstDone <- err
+	}()
+	<-started
+
+	waiterDone := make(chan error)
+	go func() {
+		_, err := prefetcher.Get(context.Background(), 1)
+		waiterDone <- err
+	}()
+
+	close(release)
+	for _, done := range []chan error{firstDone, waiterDone} {
+		err := <-done
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "loader panicked: boom")
+	}
+}
+
+func TestPrefetcher_AbandonedScan(t *testing.T) {
+	blocks := newPrefetchTestCache(t)
+	loader := &testBlockLoader{}
+	prefetcher := NewPrefetcher(blocks, loader.load, 1000, WithPrefetchDepth(3), WithPrefetchIdleTimeout(10*time.Millisecond))
+	defer prefetcher.Close()
+
+	for num := uint64(1); num <= 2; num++ {
+		_, err := prefetcher.Get(context.Background(), num)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return prefetcher.Stats().Prefetched == 3 }, time.Second, time.Millisecond)
+	require.Equal(t, 30, prefetcher.Stats().PendingBytes)
+
+	// The scan stops, the next read releases the budget it held
+	time.Sleep(20 * time.Millisecond)
+	_, err := prefetcher.Get(context.Background(), 100)
+	require.NoError(t, err)
+	require.Equal(t, 0, prefetcher.Stats().PendingBytes)
+	require.Len(t, blocks.Keys(3, 5), 3)
+}
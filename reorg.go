@@ -0,0 +1,69 @@
+package atm
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// InvalidateAbove removes every block numbered above blockNum, typically the
+// fork point of a chain reorganization. Blocks are removed from the cache and
+// their files deleted before any concurrent read can see them again. It
+// returns how many blocks and bytes were invalidated, the first file deletion
+// error is returned after all blocks have been processed.
+func (b *BlockCache) InvalidateAbove(blockNum uint64) (removed int, removedBytes int, err error) {
+	c := b.cache
+	defer c.dispatchEvents()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, 0, ErrClosed
+	}
+
+	var keys []string
+	if blockNum < ^uint64(0) {
+		for _, key := range c.blocks.between(blockNum+1, ^uint64(0)) {
+			keys = append(keys, key.String())
+		}
+	}
+
+	return b.invalidateWithLock(keys, zap.Uint64("above", blockNum))
+}
+
+// InvalidateBranch removes the blocks with one of the given IDs, whatever
+// their number, the same way InvalidateAbove does.
+func (b *BlockCache) InvalidateBranch(blockIDs ...string) (removed int, removedBytes int, err error) {
+	c := b.cache
+	defer c.dispatchEvents()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, 0, ErrClosed
+	}
+
+	ids := make(map[string]bool, len(blockIDs))
+	for _, id := range blockIDs {
+		ids[id] = true
+	}
+
+	var keys []string
+	for _, key := range c.blocks.withIDs(ids) {
+		keys = append(keys, key.String())
+	}
+
+	return b.invalidateWithLock(keys, zap.Int("branch_length", len(blockIDs)))
+}
+
+func (b *BlockCache) invalidateWithLock(keys []string, field zap.Field) (removed int, removedBytes int, err error) { //this func should always be call within a cache lock
+	c := b.cache
+	removed, removedBytes, err = c.invalidateWithLock(keys, ReasonReorg)
+	atomic.AddUint64(&c.stats.reorgBlocks, uint64(removed))
+	atomic.AddUint64(&c.stats.reorgBytes, uint64(removedBytes))
+
+	zlog.Info("invalidated reorganized blocks", field, zap.Int("count", removed), zap.Int("bytes", removedBytes))
+	return
+}
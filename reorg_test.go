@@ -0,0 +1,99 @@
+package atm
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newReorgTestCache(t *testing.T) (*BlockCache, *MemoryIO) {
+	t.Helper()
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	cache := NewCache("/cache", 10_000, 10_000, store)
+	t.Cleanup(func() { cache.Close(context.Background()) })
+
+	blocks := NewBlockCache(cache)
+	for _, key := range []BlockKey{{10, "a"}, {11, "a"}, {12, "a"}, {13, "a"}, {13, "b"}, {14, "a"}, {14, "b"}} {
+		_, err := blocks.Write(key, ttime(int(key.Num)), ttime(int(key.Num)), []byte("block-"+key.ID))
+		require.NoError(t, err)
+	}
+
+	return blocks, store
+}
+
+func TestBlockCache_InvalidateAbove(t *testing.T) {
+	blocks, store := newReorgTestCache(t)
+	events := recordEvents(blocks.Cache())
+
+	removed, removedBytes, err := blocks.InvalidateAbove(12)
+	require.NoError(t, err)
+	require.Equal(t, 4, removed)
+	require.Equal(t, 28, removedBytes)
+
+	require.Equal(t, []BlockKey{{10, "a"}, {11, "a"}, {12, "a"}}, blocks.Keys(0, 100))
+	require.Equal(t, 3, store.Len())
+	requireConsistent(t, blocks.Cache(), store)
+	require.Equal(t, []string{"13.a:reorg", "13.b:reorg", "14.a:reorg", "14.b:reorg"}, events.get("evict"))
+
+	stats := blocks.Cache().Stats()
+	require.Equal(t, uint64(4), stats.ReorgBlocks)
+	require.Equal(t, uint64(28), stats.ReorgBytes)
+
+	removed, _, err = blocks.InvalidateAbove(^uint64(0))
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+}
+
+func TestBlockCache_InvalidateBranch(t *testing.T) {
+	blocks, store := newReorgTestCache(t)
+
+	removed, removedBytes, err := blocks.InvalidateBranch("b", "unknown")
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	require.Equal(t, 14, removedBytes)
+
+	require.Equal(t, []BlockKey{{13, "a"}, {14, "a"}}, blocks.Keys(13, 14))
+	require.Equal(t, 5, store.Len())
+	requireConsistent(t, blocks.Cache(), store)
+}
+
+func TestBlockCache_InvalidateAboveConcurrentReads(t *testing.T) {
+	blocks, _ := newReorgTestCache(t)
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				read, err := blocks.ReadRange(0, 100)
+				require.NoError(t, err)
+				for _, block := range read {
+					require.Equal(t, "block-"+block.Key.ID, string(block.Data))
+				}
+			}
+		}()
+	}
+
+	_, _, err := blocks.InvalidateAbove(10)
+	require.NoError(t, err)
+
+	for _, key := range []BlockKey{{11, "a"}, {13, "b"}, {14, "a"}} {
+		_, found, err := blocks.Read(key)
+		require.NoError(t, err)
+		require.False(t, found)
+	}
+
+	close(done)
+	readers.Wait()
+}
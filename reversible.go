@@ -0,0 +1,139 @@
+package atm
+
+import (
+	"container/heap"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// Reversible marks the written item as a reversible block, kept in the tier set
+// with WithReversibleTier until BlockCache.MarkIrreversible settles its number.
+// The option has no effect on a cache without reversible tier.
+func Reversible() WriteOption {
+	return func(o *writeOptions) {
+		o.reversible = true
+	}
+}
+
+// trackWithLock hands cacheItem to the tier owning it, making room for
+// neededBytes: the reversible tier for reversible items, the eviction policy
+// otherwise.
+func (c *Cache) trackWithLock(cacheItem *CacheItem, neededBytes int) { //this func should always be call within a cache lock
+	if !cacheItem.reversible {
+		c.applyEvictionsWithLock(c.policy.Victims(neededBytes))
+		c.policy.OnInsert(cacheItem)
+		return
+	}
+
+	for _, evicted := range purge(c.reversible, neededBytes) {
+		c.dropWithLock(evicted, ReasonCapacity)
+	}
+	heap.Push(c.reversible, cacheItem)
+}
+
+// untrackWithLock takes cacheItem out of the tier owning it.
+func (c *Cache) untrackWithLock(cacheItem *CacheItem) { //this func should always be call within a cache lock
+	if cacheItem.reversible {
+		c.reversible.Remove(cacheItem.key)
+		return
+	}
+	c.policy.OnRemove(cacheItem)
+}
+
+// accessedWithLock reports an access to cacheItem to the tier owning it.
+func (c *Cache) accessedWithLock(cacheItem *CacheItem) { //this func should always be call within a cache lock
+	switch {
+	case cacheItem.pinned:
+	case cacheItem.reversible:
+		c.reversible.Fix(cacheItem.key)
+	default:
+		c.policy.OnAccess(cacheItem)
+	}
+}
+
+// trimReversibleWithLock drops the oldest reversible items going over budget,
+// which might have been lowered since the manifest checkpoint.
+func (c *Cache) trimReversibleWithLock() { //this func should always be call within a cache lock
+	if c.reversible == nil {
+		return
+	}
+
+	for _, evicted := range purge(c.reversible, 0) {
+		c.dropWithLock(evicted, ReasonCapacity)
+	}
+}
+
+// MarkIrreversible moves the reversible blocks numbered up to upToBlock out of
+// the reversible tier to the age tier of the eviction policy, or hands them to
+// the policy as newly written items when it has no such tier. Promote
+// listeners are notified with ReasonIrreversible. canonical lists the blocks
+// the chain settled on: a block is only considered part of an abandoned fork,
+// and invalidated with ReasonReorg, when another block of its number is listed.
+// Blocks whose number has no listed block are promoted, so listing only the
+// new irreversible head never drops the chain below it. Blocks numbered above
+// upToBlock and pinned blocks are left as they are. It returns how many
+// blocks were moved and dropped.
+func (b *BlockCache) MarkIrreversible(upToBlock uint64, canonical ...BlockKey) (promoted int, dropped int, err error) {
+	c := b.cache
+	defer c.dispatchEvents()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, 0, ErrClosed
+	}
+	if c.reversible == nil {
+		return 0, 0, nil
+	}
+
+	isCanonical := make(map[BlockKey]bool, len(canonical))
+	settled := make(map[uint64]bool, len(canonical))
+	for _, key := range canonical {
+		isCanonical[key] = true
+		settled[key.Num] = true
+	}
+
+	var irreversible []*CacheItem
+	var forked []string
+	for _, cacheItem := range c.reversible.items {
+		key, err := ParseBlockKey(cacheItem.key)
+		if err != nil || key.Num > upToBlock {
+			continue
+		}
+
+		if settled[key.Num] && !isCanonical[key] {
+			forked = append(forked, cacheItem.key)
+		} else {
+			irreversible = append(irreversible, cacheItem)
+		}
+	}
+	sort.Slice(irreversible, func(i, j int) bool {
+		return irreversible[i].itemDate.Before(irreversible[j].itemDate)
+	})
+
+	if len(forked) > 0 {
+		dropped, _, err = b.invalidateWithLock(forked, zap.Uint64("irreversible", upToBlock))
+	}
+
+	policy, tiered := c.policy.(tieredPolicy)
+	for _, cacheItem := range irreversible {
+		c.reversible.Remove(cacheItem.key)
+		cacheItem.reversible = false
+
+		if tiered {
+			policy.restore(cacheItem, heapAge)
+		} else {
+			c.applyEvictionsWithLock(c.policy.Victims(cacheItem.size))
+			c.policy.OnInsert(cacheItem)
+		}
+		c.emitWithLock(eventPromote, cacheItem, ReasonIrreversible)
+	}
+	if tiered {
+		c.applyEvictionsWithLock(policy.trim())
+	}
+
+	zlog.Debug("marked blocks irreversible", zap.Uint64("up_to_block", upToBlock), zap.Int("promoted", len(irreversible)), zap.Int("dropped", dropped))
+	return len(irreversible), dropped, err
+}
@@ -0,0 +1,127 @@
+package atm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCache_ReversibleTier(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	cache := NewCache("/cache", 10, 10, store, WithReversibleTier(6))
+	defer cache.Close(context.Background())
+	events := recordEvents(cache)
+
+	blocks := NewBlockCache(cache)
+	write := func(key BlockKey, insertedAt int, opts ...WriteOption) {
+		t.Helper()
+		_, err := blocks.Write(key, ttime(int(key.Num)), ttime(insertedAt), []byte("12"), opts...)
+		require.NoError(t, err)
+		requireConsistent(t, cache, store)
+	}
+
+	write(BlockKey{1, "a"}, 0)
+	write(BlockKey{10, "a"}, 1, Reversible())
+	write(BlockKey{11, "a"}, 2, Reversible())
+	write(BlockKey{12, "a"}, 3, Reversible())
+	require.True(t, recentAge(cache).recentEntryHeap.Contains("1.a"))
+	require.Equal(t, 1, recentAge(cache).recentEntryHeap.Len())
+
+	stats := cache.Stats()
+	require.Equal(t, 3, stats.ReversibleCount)
+	require.Equal(t, 6, stats.ReversibleBytes)
+
+	// The reversible budget is independent, the oldest reversible block goes
+	write(BlockKey{12, "b"}, 4, Reversible())
+	require.Equal(t, []BlockKey{{1, "a"}, {11, "a"}, {12, "a"}, {12, "b"}}, blocks.Keys(0, 100))
+	require.Equal(t, []string{"10.a:capacity"}, events.get("evict"))
+
+	// Pinned reversible blocks are left alone
+	pinned, err := cache.Pin("11.a")
+	require.NoError(t, err)
+	require.True(t, pinned)
+	requireConsistent(t, cache, store)
+
+	// Only the canonical block of a forked number reaches the age tier
+	promoted, dropped, err := blocks.MarkIrreversible(12, BlockKey{12, "a"})
+	require.NoError(t, err)
+	require.Equal(t, 1, promoted)
+	require.Equal(t, 1, dropped)
+	requireConsistent(t, cache, store)
+	require.True(t, recentAge(cache).ageHeap.Contains("12.a"))
+	require.Equal(t, []BlockKey{{12, "a"}}, blocks.Keys(12, 12))
+	require.Equal(t, []string{"12.a:irreversible"}, events.get("promote"))
+	require.Equal(t, []string{"10.a:capacity", "12.b:reorg"}, events.get("evict"))
+	_, err = store.load(cache.toFilePath("12.b", ttime(12)))
+	require.Error(t, err)
+	require.Equal(t, uint64(1), cache.Stats().ReorgBlocks)
+
+	_, err = cache.Unpin("11.a")
+	require.NoError(t, err)
+	requireConsistent(t, cache, store)
+	require.True(t, cache.reversible.Contains("11.a"))
+
+	promoted, dropped, err = blocks.MarkIrreversible(11)
+	require.NoError(t, err)
+	require.Equal(t, 1, promoted)
+	require.Equal(t, 0, dropped)
+	require.True(t, recentAge(cache).ageHeap.Contains("11.a"))
+	requireConsistent(t, cache, store)
+
+	// Listing only the new head keeps the unlisted blocks below it
+	write(BlockKey{13, "a"}, 5, Reversible())
+	write(BlockKey{14, "a"}, 6, Reversible())
+	write(BlockKey{15, "a"}, 7, Reversible())
+	promoted, dropped, err = blocks.MarkIrreversible(14, BlockKey{14, "a"})
+	require.NoError(t, err)
+	require.Equal(t, 2, promoted)
+	require.Equal(t, 0, dropped)
+	require.True(t, recentAge(cache).ageHeap.Contains("13.a"))
+	require.True(t, cache.reversible.Contains("15.a"))
+	requireConsistent(t, cache, store)
+
+	promoted, dropped, err = blocks.MarkIrreversible(0)
+	require.NoError(t, err)
+	require.Equal(t, 0, promoted+dropped)
+}
+
+func TestBlockCache_ReversibleTierWithoutTier(t *testing.T) {
+	SystemBlockSize = 0
+	cache := NewCache("/cache", 10, 10, NewMemoryIO())
+	defer cache.Close(context.Background())
+
+	blocks := NewBlockCache(cache)
+	_, err := blocks.Write(BlockKey{1, "a"}, ttime(1), ttime(1), []byte("12"), Reversible())
+	require.NoError(t, err)
+	require.False(t, cache.index["1.a"].reversible)
+	require.True(t, recentAge(cache).recentEntryHeap.Contains("1.a"))
+
+	promoted, dropped, err := blocks.MarkIrreversible(1, BlockKey{1, "a"})
+	require.NoError(t, err)
+	require.Equal(t, 0, promoted+dropped)
+}
+
+func TestBlockCache_ReversibleTierManifestRestore(t *testing.T) {
+	SystemBlockSize = 0
+	basePath := t.TempDir()
+
+	cache, err := NewInitializedCache(basePath, 100, 100, NewFileIO(), WithReversibleTier(100))
+	require.NoError(t, err)
+
+	blocks := NewBlockCache(cache)
+	_, err = blocks.Write(BlockKey{1, "a"}, ttime(1), ttime(1), []byte("12"))
+	require.NoError(t, err)
+	_, err = blocks.Write(BlockKey{2, "a"}, ttime(2), ttime(2), []byte("12"), Reversible())
+	require.NoError(t, err)
+	require.NoError(t, cache.Close(context.Background()))
+
+	restored, err := NewInitializedCache(basePath, 100, 100, NewFileIO(), WithReversibleTier(100))
+	require.NoError(t, err)
+	defer restored.Close(context.Background())
+
+	requireConsistent(t, restored, nil)
+	require.True(t, restored.reversible.Contains("2.a"))
+	require.True(t, recentAge(restored).recentEntryHeap.Contains("1.a"))
+}
@@ -0,0 +1,201 @@
+package atm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the IO latency histograms.
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Stats is a point in time snapshot of the cache counters.
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+	// MemoryHits counts the hits served by the memory tier, without IO.
+	MemoryHits uint64
+
+	ItemCount int
+	// The heap counts, bytes and evictions are only reported by the default
+	// RecentAgePolicy
+	RecentEntryCount int
+	AgeCount         int
+	RecentEntryBytes int
+	AgeBytes         int
+	PinnedCount      int
+	PinnedBytes      int
+	ReversibleCount  int
+	ReversibleBytes  int
+	MemoryItemCount  int
+	MemoryBytes      int
+
+	// RecentEntryEvictions counts items pushed out of the recent entry heap,
+	// AgeEvictions counts items pushed out of the age heap.
+	RecentEntryEvictions uint64
+	AgeEvictions         uint64
+	DeleteFailures       uint64
+	// Corruptions counts reads that failed checksum verification.
+	Corruptions uint64
+	// Expirations counts items removed because their TTL elapsed.
+	Expirations uint64
+	// AdmissionRejections counts writes refused by the admission filter.
+	AdmissionRejections uint64
+	// ReorgBlocks and ReorgBytes count the blocks invalidated by a chain
+	// reorganization.
+	ReorgBlocks uint64
+	ReorgBytes  uint64
+
+	ReadLatency   LatencyStats
+	WriteLatency  LatencyStats
+	DeleteLatency LatencyStats
+}
+
+// HitRatio returns the ratio of reads served from the cache, 0 when nothing
+// was read yet.
+func (s Stats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(total)
+}
+
+// LatencyStats is a histogram of CacheIO operation durations.
+type LatencyStats struct {
+	Count uint64
+	Sum   time.Duration
+	// Buckets hold cumulative counts, one per LatencyBuckets entry.
+	Buckets []LatencyBucket
+}
+
+type LatencyBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+type ioOperation int
+
+const (
+	ioRead ioOperation = iota
+	ioWrite
+	ioDelete
+	ioOperationCount
+)
+
+// cacheStats holds the counters updated outside of the cache lock, it is
+// always allocated on its own so its uint64 fields are 64-bit aligned.
+type cacheStats struct {
+	hits           uint64
+	misses         uint64
+	memoryHits     uint64
+	deleteFailures uint64
+	corruptions    uint64
+	expirations    uint64
+	rejections     uint64
+	reorgBlocks    uint64
+	reorgBytes     uint64
+
+	latencies [ioOperationCount]*latencyHistogram
+}
+
+func newCacheStats() *cacheStats {
+	s := &cacheStats{}
+	for i := range s.latencies {
+		s.latencies[i] = newLatencyHistogram()
+	}
+
+	return s
+}
+
+func (s *cacheStats) observe(op ioOperation, start time.Time) {
+	s.latencies[op].observe(time.Since(start))
+}
+
+type latencyHistogram struct {
+	count   uint64
+	sum     uint64
+	buckets []uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{buckets: make([]uint64, len(LatencyBuckets))}
+}
+
+func (h *latencyHistogram) observe(elapsed time.Duration) {
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(elapsed))
+
+	for i, upperBound := range LatencyBuckets {
+		if elapsed <= upperBound {
+			atomic.AddUint64(&h.buckets[i], 1)
+			return
+		}
+	}
+}
+
+func (h *latencyHistogram) snapshot() LatencyStats {
+	out := LatencyStats{
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     time.Duration(atomic.LoadUint64(&h.sum)),
+		Buckets: make([]LatencyBucket, len(LatencyBuckets)),
+	}
+
+	var cumulative uint64
+	for i, upperBound := range LatencyBuckets {
+		cumulative += atomic.LoadUint64(&h.buckets[i])
+		out.Buckets[i] = LatencyBucket{UpperBound: upperBound, Count: cumulative}
+	}
+
+	return out
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	out := Stats{
+		ItemCount:   len(c.index),
+		PinnedCount: c.pinnedCount,
+		PinnedBytes: c.pinnedBytes,
+	}
+	if policy, ok := c.policy.(*RecentAgePolicy); ok {
+		out.RecentEntryCount = policy.recentEntryHeap.Len()
+		out.AgeCount = policy.ageHeap.Len()
+		out.RecentEntryBytes = policy.recentEntryHeap.sizeInBytes
+		out.AgeBytes = policy.ageHeap.sizeInBytes
+		out.RecentEntryEvictions = policy.recentEntryEvictions
+		out.AgeEvictions = policy.ageEvictions
+	}
+	if c.reversible != nil {
+		out.ReversibleCount = c.reversible.Len()
+		out.ReversibleBytes = c.reversible.sizeInBytes
+	}
+	c.mu.RUnlock()
+
+	out.MemoryItemCount, out.MemoryBytes = c.memory.stats()
+	out.Hits = atomic.LoadUint64(&c.stats.hits)
+	out.Misses = atomic.LoadUint64(&c.stats.misses)
+	out.MemoryHits = atomic.LoadUint64(&c.stats.memoryHits)
+	out.DeleteFailures = atomic.LoadUint64(&c.stats.deleteFailures)
+	out.Corruptions = atomic.LoadUint64(&c.stats.corruptions)
+	out.Expirations = atomic.LoadUint64(&c.stats.expirations)
+	out.AdmissionRejections = atomic.LoadUint64(&c.stats.rejections)
+	out.ReorgBlocks = atomic.LoadUint64(&c.stats.reorgBlocks)
+	out.ReorgBytes = atomic.LoadUint64(&c.stats.reorgBytes)
+	out.ReadLatency = c.stats.latencies[ioRead].snapshot()
+	out.WriteLatency = c.stats.latencies[ioWrite].snapshot()
+	out.DeleteLatency = c.stats.latencies[ioDelete].snapshot()
+
+	return out
+}
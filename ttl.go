@@ -0,0 +1,111 @@
+package atm
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultExpirationInterval is how often expired items are removed from the
+// cache, unless configured with WithExpirationInterval.
+const DefaultExpirationInterval = time.Second
+
+// WriteOption configures how a single item is written.
+type WriteOption func(o *writeOptions)
+
+type writeOptions struct {
+	ttl        time.Duration
+	reversible bool
+}
+
+func newWriteOptions(opts []WriteOption) *writeOptions {
+	o := &writeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithTTL makes the item expire ttl after being written. Expired items are
+// reported as misses, then removed from the cache in the background. Writing
+// an expired key replaces it.
+func WithTTL(ttl time.Duration) WriteOption {
+	return func(o *writeOptions) {
+		o.ttl = ttl
+	}
+}
+
+func (o *writeOptions) apply(item *CacheItem, now time.Time) {
+	if o.ttl > 0 {
+		item.expiresAt = now.Add(o.ttl)
+	}
+	item.reversible = o.reversible
+}
+
+func ByExpiration(h []*CacheItem, i, j int) bool {
+	return h[i].expiresAt.Before(h[j].expiresAt)
+}
+
+// expired reports whether the item has a TTL which elapsed at now.
+func (i *CacheItem) expired(now time.Time) bool {
+	return !i.expiresAt.IsZero() && !now.Before(i.expiresAt)
+}
+
+// trackExpiryWithLock registers a newly indexed item with the expirer when it
+// has a TTL.
+func (c *Cache) trackExpiryWithLock(cacheItem *CacheItem) { //this func should always be call within a cache lock
+	if !cacheItem.expiresAt.IsZero() {
+		heap.Push(c.expiryHeap, cacheItem)
+	}
+}
+
+func (c *Cache) expireLoop() {
+	ticker := time.NewTicker(c.expirationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.expire()
+		}
+	}
+}
+
+// expire removes every expired item from the index, the heaps and the CacheIO.
+func (c *Cache) expire() {
+	defer c.dispatchEvents()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	now := c.now()
+	expired := 0
+	for peek := c.expiryHeap.Peek(); peek != nil && peek.expired(now); peek = c.expiryHeap.Peek() {
+		c.expireWithLock(c.removeWithLock(peek.key))
+		expired++
+	}
+
+	if expired > 0 {
+		zlog.Debug("expired cache items", zap.Int("count", expired))
+	}
+}
+
+// expireWithLock reports the removal of an expired item and deletes its
+// backing file. The file is deleted right away, the key is typically written
+// again to the same path once reloaded.
+func (c *Cache) expireWithLock(cacheItem *CacheItem) { //this func should always be call within a cache lock
+	atomic.AddUint64(&c.stats.expirations, 1)
+	c.emitWithLock(eventEvict, cacheItem, ReasonExpired)
+	if err := c.deleteFileWithLock(cacheItem, ReasonExpired); err != nil {
+		zlog.Warn("failed to delete expired file", zap.String("file", cacheItem.filePath), zap.Error(err))
+	}
+}
@@ -0,0 +1,150 @@
+package atm
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withNow replaces the clock of the cache before its background routines start.
+func withNow(now func() time.Time) Option {
+	return func(c *Cache) {
+		c.now = now
+	}
+}
+
+func TestCache_TTL(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	now := ttime(0)
+	cache := NewCache("/cache", 100, 100, store, WithExpirationInterval(0), withNow(func() time.Time { return now }))
+	defer cache.Close(context.Background())
+	events := recordEvents(cache)
+
+	_, err := cache.Write("a", ttime(0), ttime(0), []byte("a"), WithTTL(10*time.Second))
+	require.NoError(t, err)
+	_, err = cache.Write("b", ttime(0), ttime(0), []byte("b"))
+	require.NoError(t, err)
+	item, err := cache.WriteFrom("c", ttime(0), ttime(0), bytes.NewReader([]byte("c")), WithTTL(5*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, ttime(5), item.ExpiresAt())
+
+	now = ttime(6)
+	_, found, err := cache.Read("c")
+	require.NoError(t, err)
+	require.False(t, found)
+	_, found, err = cache.OpenReader("c")
+	require.NoError(t, err)
+	require.False(t, found)
+	data, found, err := cache.Read("a")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("a"), data)
+
+	now = ttime(11)
+	cache.expire()
+	requireConsistent(t, cache, store)
+	require.Len(t, cache.index, 1)
+	require.Equal(t, 0, cache.expiryHeap.Len())
+	require.Equal(t, uint64(2), cache.Stats().Expirations)
+
+	// Writing an expired key replaces it, keeping the file it overwrote
+	_, err = cache.Write("d", ttime(0), ttime(0), []byte("old"), WithTTL(time.Second))
+	require.NoError(t, err)
+	now = ttime(13)
+	_, err = cache.Write("d", ttime(0), ttime(0), []byte("new"))
+	require.NoError(t, err)
+
+	data, found, err = cache.Read("d")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("new"), data)
+	requireConsistent(t, cache, store)
+
+	require.NoError(t, cache.Close(context.Background()))
+	require.Equal(t, 2, store.Len())
+	require.Equal(t, []string{"a:expired", "c:expired", "d:expired"}, events.get("evict"))
+	require.Equal(t, []string{"a:expired", "c:expired"}, events.get("delete"))
+}
+
+func TestCache_ExpireLoop(t *testing.T) {
+	cache := NewCache(t.TempDir(), 100_000, 100_000, NewFileIO(), WithExpirationInterval(10*time.Millisecond))
+	defer cache.Close(context.Background())
+
+	calls := 0
+	loader := func(ctx context.Context) ([]byte, error) {
+		calls++
+		return []byte("data"), nil
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.GetOrLoad(context.Background(), "a", ttime(0), loader, WithTTL(20*time.Millisecond))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, calls)
+
+	require.Eventually(t, func() bool {
+		return cache.Stats().ItemCount == 0
+	}, time.Second, 10*time.Millisecond)
+
+	_, err := cache.GetOrLoad(context.Background(), "a", ttime(0), loader)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestCache_TTLManifest(t *testing.T) {
+	basePath := t.TempDir()
+
+	cache, err := NewInitializedCache(basePath, 100_000, 100_000, NewFileIO())
+	require.NoError(t, err)
+	written, err := cache.Write("a", ttime(0), ttime(0), []byte("a"), WithTTL(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, cache.Close(context.Background()))
+
+	reopened, err := NewInitializedCache(basePath, 100_000, 100_000, NewFileIO())
+	require.NoError(t, err)
+	defer reopened.Close(context.Background())
+
+	require.True(t, written.ExpiresAt().Equal(reopened.index["a"].ExpiresAt()))
+	require.True(t, reopened.expiryHeap.Contains("a"))
+}
+
+// slowDeleteIO delays file deletions, so they are still pending when the
+// cache moves on.
+type slowDeleteIO struct {
+	CacheIO
+	delay time.Duration
+}
+
+func (s *slowDeleteIO) Delete(path string) error {
+	time.Sleep(s.delay)
+	return s.CacheIO.Delete(path)
+}
+
+func TestCache_TTLRewriteDuringDelete(t *testing.T) {
+	SystemBlockSize = 0
+	store := NewMemoryIO()
+	now := ttime(0)
+	cache := NewCache("/cache", 100, 100, &slowDeleteIO{CacheIO: store, delay: 20 * time.Millisecond}, WithExpirationInterval(0), withNow(func() time.Time { return now }))
+	defer cache.Close(context.Background())
+
+	_, err := cache.Write("a", ttime(0), ttime(0), []byte("old"), WithTTL(time.Second))
+	require.NoError(t, err)
+
+	now = ttime(2)
+	cache.expire()
+
+	// Reloaded after expiry, the key is written to the path of the expired file
+	_, err = cache.Write("a", ttime(0), ttime(2), []byte("new"), WithTTL(time.Second))
+	require.NoError(t, err)
+
+	time.Sleep(40 * time.Millisecond)
+	data, found, err := cache.Read("a")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []byte("new"), data)
+	requireConsistent(t, cache, store)
+}